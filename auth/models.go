@@ -1,6 +1,7 @@
 package auth
 
 import (
+	"go-on-rails/common"
 	"log"
 	"time"
 
@@ -12,6 +13,24 @@ import (
 var AuthDb *sqlx.DB
 var Store *session.Store
 
+// Runtime settings of the auth module, changed on /admin/settings.
+var (
+	SignupOpen = common.NewSetting("auth.signup_open", common.SettingOptions[bool]{
+		Label:       "Signups open",
+		Description: "Whether new users can sign up (with a signup code).",
+		Group:       "Auth",
+		Default:     true,
+	})
+	PasswordMinLength = common.NewSetting("auth.password_min_length", common.SettingOptions[int]{
+		Label:       "Minimum password length",
+		Description: "Applies to new passwords, existing ones keep working.",
+		Group:       "Auth",
+		Default:     6,
+		Min:         1,
+		Max:         128,
+	})
+)
+
 type UserMetadata struct {
 	ID        int       `db:"id"`
 	Email     string    `db:"email"`
@@ -33,7 +52,9 @@ func init() {
 	})
 
 	var err error
-	AuthDb, err = sqlx.Open("sqlite3", "./db/auth.db")
+	// The mailing queue shares this database with the other instances of the app,
+	// wait for their writes instead of failing with "database is locked".
+	AuthDb, err = sqlx.Open("sqlite3", "./db/auth.db?_busy_timeout=5000")
 	if err != nil {
 		log.Fatalf("Error opening database: %v", err)
 	}
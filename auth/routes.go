@@ -1,13 +1,18 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"go-on-rails/common"
+	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -16,10 +21,70 @@ import (
 )
 
 var mailingQueue *common.Queue
+var maintenanceQueue *common.Queue
 
 func init() {
-	mailingQueue = common.NewQueue(common.QueueOptions{})
+	// Emails are persisted in auth.db so they aren't lost on restart or deploy.
+	// SMTP servers can be flaky, so failed emails are retried for about 45 minutes
+	// before they end up in the dead letters.
+	// A single attempt gets 30 seconds, so an unresponsive SMTP server can't block the queue.
+	// Password reset emails are capped so the forgot password form can't be used to flood the SMTP server.
+	// Transactional emails (i.e. password resets) go in their own lane so they don't wait behind bulk emails.
+	mailingQueue = common.NewQueue(common.QueueOptions{
+		Name:       "mailing",
+		Db:         AuthDb,
+		JobTimeout: 30 * time.Second,
+		Retry: common.RetryPolicy{
+			MaxAttempts: 8,
+			Backoff:     30 * time.Second,
+			MaxBackoff:  15 * time.Minute,
+			Jitter:      0.2,
+		},
+		RateLimits: []common.RateLimit{
+			{Prefix: "send-forgot-password-email-", Limit: 30, Per: time.Minute},
+		},
+		Lanes: []common.Lane{
+			{Name: "transactional", Weight: 10},
+			{Name: "bulk", Weight: 1},
+		},
+	})
+	mailingQueue.RegisterHandler("send-forgot-password-email", sendForgotPasswordEmail)
 	mailingQueue.StartJobQueue()
+
+	// Housekeeping jobs, they run on a schedule so there's nothing to persist.
+	maintenanceQueue = common.NewQueue(common.QueueOptions{Name: "maintenance"})
+	maintenanceQueue.StartJobQueue()
+	err := maintenanceQueue.Schedule("@hourly", common.Job{
+		Name: "purge-expired-password-resets",
+		Func: purgeExpiredPasswordResets,
+	})
+	if err != nil {
+		log.Fatalf("Error scheduling job: %v", err)
+	}
+}
+
+type forgotPasswordEmail struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+// Sends the email with the link to reset the password. Runs on the mailing queue.
+func sendForgotPasswordEmail(ctx context.Context, payload []byte) error {
+	var email forgotPasswordEmail
+	err := json.Unmarshal(payload, &email)
+	if err != nil {
+		return err
+	}
+	if common.Mailer == nil {
+		return fmt.Errorf("mailer is not configured")
+	}
+	return common.Mailer.SendMailContext(ctx, []string{email.Email}, "Password Reset", common.Env.BASE_URL+"/reset-password?token="+email.Token)
+}
+
+// Deletes the password reset tokens that are too old to be used. (i.e. older than 1 hour)
+func purgeExpiredPasswordResets() error {
+	_, err := AuthDb.Exec(`DELETE FROM password_resets WHERE created_at < datetime('now', '-1 hour')`)
+	return err
 }
 
 func AddRoutes(app *fiber.App) {
@@ -47,6 +112,13 @@ func AddRoutes(app *fiber.App) {
 	app.Post("/admin/signup-codes/delete/:code", admin.delete_signup_code)
 	app.Get("/admin/signup-codes/:code", admin.get_edit_signup_code)
 	app.Post("/admin/signup-codes/:code", admin.put_signup_code)
+	app.Get("/admin/jobs", admin.get_jobs)
+	app.Post("/admin/jobs/:queue/running/:id/cancel", admin.post_cancel_job)
+	app.Post("/admin/jobs/:queue/dead/:id/retry", admin.post_retry_dead_job)
+	app.Post("/admin/jobs/:queue/dead/:id/delete", admin.post_delete_dead_job)
+	app.Post("/admin/jobs/:queue/pending/:id/delete", admin.post_delete_pending_job)
+	app.Get("/admin/settings", admin.get_settings)
+	app.Post("/admin/settings", admin.post_settings)
 }
 
 type AuthHandlers struct {
@@ -65,6 +137,10 @@ func (m *AuthHandlers) get_signup(c *fiber.Ctx) error {
 		return c.Redirect("/protected")
 	}
 
+	if !SignupOpen.Get() {
+		return c.Redirect("/login?error=Signups are closed")
+	}
+
 	// render the signup page
 	return common.RenderTempl(c, signup_page(Messages{
 		Success: c.Query("success"),
@@ -85,6 +161,10 @@ func (m *AuthHandlers) post_signup(c *fiber.Ctx) error {
 		return c.Redirect("/protected")
 	}
 
+	if !SignupOpen.Get() {
+		return c.Redirect("/login?error=Signups are closed")
+	}
+
 	// get email and password from the form
 	email := c.FormValue("email")
 	password := c.FormValue("password")
@@ -97,8 +177,8 @@ func (m *AuthHandlers) post_signup(c *fiber.Ctx) error {
 	if !strings.Contains(email, "@") {
 		return c.Redirect("/signup?error=Please enter a valid email")
 	}
-	if len(password) < 6 {
-		return c.Redirect("/signup?error=Password must be at least 6 characters")
+	if msg := checkPassword(password); msg != "" {
+		return c.Redirect("/signup?error=" + msg)
 	}
 	if code == "" {
 		return c.Redirect("/signup?error=Please enter your signup code")
@@ -208,9 +288,6 @@ func (m *AuthHandlers) post_login(c *fiber.Ctx) error {
 	if !strings.Contains(email, "@") {
 		return c.Redirect("/login?error=Please enter a valid email")
 	}
-	if len(password) < 6 {
-		return c.Redirect("/login?error=Password must be at least 6 characters")
-	}
 
 	// check if the user exists in the database
 	type User struct {
@@ -292,8 +369,8 @@ func (m *AuthHandlers) post_change_pass(c *fiber.Ctx) error {
 	if password == "" || newPassword == "" || confirmPassword == "" {
 		return c.Redirect("/change-password?error=Please enter your password, new password, and confirm password")
 	}
-	if len(newPassword) < 6 {
-		return c.Redirect("/change-password?error=New password must be at least 6 characters")
+	if msg := checkPassword(newPassword); msg != "" {
+		return c.Redirect("/change-password?error=New " + strings.ToLower(msg[:1]) + msg[1:])
 	}
 	if newPassword != confirmPassword {
 		return c.Redirect("/change-password?error=New password and confirm password do not match")
@@ -385,13 +462,24 @@ func (m *AuthHandlers) post_forgot_pass(c *fiber.Ctx) error {
 
 	// Check if mailer is configured and send email with link to reset password
 	if common.Mailer != nil && common.IsValidMailer(common.Mailer) {
-		mailingQueue.AddJob(common.Job{
-			Name: fmt.Sprintf("send-forgot-password-email-%s", email),
-			Func: func() error {
-				return common.Mailer.SendMail([]string{email}, "Password Reset", common.Env.BASE_URL+"/reset-password?token="+token)
-			},
-			Lockable: true, // don't want to send multiple emails at the same time to the same user
+		err = mailingQueue.AddJob(common.Job{
+			Name:      fmt.Sprintf("send-forgot-password-email-%s", email),
+			Handler:   "send-forgot-password-email",
+			Payload:   forgotPasswordEmail{Email: email, Token: token},
+			Lane:      "transactional",
+			Lockable:  true,             // don't want to send multiple emails at the same time to the same user
+			UniqueFor: 10 * time.Minute, // nor more than one every 10 minutes
 		})
+		if errors.Is(err, common.ErrJobDuplicate) {
+			return c.Redirect("/forgot-password?error=We already sent you an email a few minutes ago, check your inbox or try again later")
+		}
+		if errors.Is(err, common.ErrJobRateLimited) {
+			return c.Redirect("/forgot-password?error=Too many password reset requests right now, please try again in a few minutes")
+		}
+		if err != nil {
+			log.Printf("Error queuing forgot password email: %v", err)
+			return c.Redirect("/forgot-password?error=Can't send you an email right now, please try again later")
+		}
 	} else {
 		return c.Redirect("/forgot-password?error=Can't send email because mailer is not configured, contact admin")
 	}
@@ -457,8 +545,8 @@ func (m *AuthHandlers) post_reset_pass(c *fiber.Ctx) error {
 	if token == "" || password == "" {
 		return c.Redirect("/reset-password?token=" + token + "&error=Please enter a password")
 	}
-	if len(password) < 6 {
-		return c.Redirect("/reset-password?token=" + token + "&error=Password must be at least 6 characters")
+	if msg := checkPassword(password); msg != "" {
+		return c.Redirect("/reset-password?token=" + token + "&error=" + msg)
 	}
 
 	// check if the token exists in the database
@@ -541,36 +629,43 @@ func (m *AdminHandlers) get_admin(c *fiber.Ctx) error {
 		return c.Redirect("/login?error=You do not have permission to view the admin page")
 	}
 
-	// get user from db
+	// load the user, all users, signup codes and SMTP settings in parallel
 	var me UserMetadata
-	err = AuthDb.Get(&me, `SELECT id, email, created_at FROM users WHERE id = ?`, userId.(int))
-	if err != nil {
-		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get user metadata:", err.Error()))
-	}
-
-	// get all users from the database
 	var users []UserMetadata
-	err = AuthDb.Select(&users, `SELECT id, email, created_at FROM users`)
-	if err != nil {
-		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get users:", err.Error()))
-	}
-
-	// get all signup codes from the database
 	var signupCodes []SignupCode
-	err = AuthDb.Select(&signupCodes, `SELECT code, uses, created_at FROM signup_codes`)
-	if err != nil {
-		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get signup codes:", err.Error()))
-	}
-
-	// get SMTP settings
 	var smtpSettings SMTPSettings
-	err = common.MailDb.Get(&smtpSettings, `SELECT host, port, username, password FROM mailer_config`)
+	err = common.Parallel(c.UserContext(),
+		func(ctx context.Context) error {
+			err := AuthDb.GetContext(ctx, &me, `SELECT id, email, created_at FROM users WHERE id = ?`, userId.(int))
+			if err != nil {
+				return fmt.Errorf("failed to get user metadata: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			err := AuthDb.SelectContext(ctx, &users, `SELECT id, email, created_at FROM users`)
+			if err != nil {
+				return fmt.Errorf("failed to get users: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			err := AuthDb.SelectContext(ctx, &signupCodes, `SELECT code, uses, created_at FROM signup_codes`)
+			if err != nil {
+				return fmt.Errorf("failed to get signup codes: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			err := common.MailDb.GetContext(ctx, &smtpSettings, `SELECT host, port, username, password FROM mailer_config`)
+			if err != nil && err != sql.ErrNoRows {
+				return fmt.Errorf("failed to get SMTP settings: %w", err)
+			}
+			return nil
+		},
+	)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			smtpSettings = SMTPSettings{}
-		} else {
-			return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get SMTP settings:", err.Error()))
-		}
+		return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to load the admin page:", err.Error()))
 	}
 
 	// render the admin page
@@ -1000,3 +1095,295 @@ func (m *AdminHandlers) delete_signup_codes(c *fiber.Ctx) error {
 	// redirect to the admin page with a success message
 	return c.Redirect("/admin?success=Deleted " + strconv.Itoa(len(codes)) + " signup codes successfully")
 }
+
+func (m *AdminHandlers) get_jobs(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get the stats, dead letters and pending jobs of every queue
+	var queues []queue_view
+	for _, q := range common.Queues() {
+		stats, err := q.Stats()
+		if err != nil {
+			return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get queue stats:", err.Error()))
+		}
+		dead, err := q.DeadJobs()
+		if err != nil {
+			return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get dead jobs:", err.Error()))
+		}
+		pending, err := q.PendingJobs(50)
+		if err != nil {
+			return common.RenderTempl(c, common.ErrorPage("💥 500", "Failed to get pending jobs:", err.Error()))
+		}
+		queues = append(queues, queue_view{Stats: stats, Dead: dead, Pending: pending})
+	}
+
+	// render the jobs page
+	return common.RenderTempl(c, jobs_page(Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, queues))
+}
+
+func (m *AdminHandlers) post_cancel_job(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get the queue and the run from the URL
+	queue := common.GetQueue(c.Params("queue"))
+	if queue == nil {
+		return c.Redirect("/admin/jobs?error=Queue not found")
+	}
+	runId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Invalid run ID")
+	}
+
+	// cancel the job, it stops as soon as it checks its context
+	err = queue.CancelRunningJob(runId)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't cancel job: " + err.Error())
+	}
+
+	// redirect to the jobs page with a success message
+	return c.Redirect("/admin/jobs?success=Canceled job successfully")
+}
+
+func (m *AdminHandlers) post_retry_dead_job(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get the queue and the dead job from the URL
+	queue := common.GetQueue(c.Params("queue"))
+	if queue == nil {
+		return c.Redirect("/admin/jobs?error=Queue not found")
+	}
+	jobId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Invalid job ID")
+	}
+
+	// put the job back in the queue with its attempts reset
+	err = queue.RequeueDeadJob(jobId)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't retry job: " + err.Error())
+	}
+
+	// redirect to the jobs page with a success message
+	return c.Redirect("/admin/jobs?success=Requeued job successfully")
+}
+
+func (m *AdminHandlers) post_delete_dead_job(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get the queue and the dead job from the URL
+	queue := common.GetQueue(c.Params("queue"))
+	if queue == nil {
+		return c.Redirect("/admin/jobs?error=Queue not found")
+	}
+	jobId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Invalid job ID")
+	}
+
+	// forget the job for good
+	err = queue.DeleteDeadJob(jobId)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't delete job: " + err.Error())
+	}
+
+	// redirect to the jobs page with a success message
+	return c.Redirect("/admin/jobs?success=Deleted job successfully")
+}
+
+func (m *AdminHandlers) post_delete_pending_job(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// get the queue and the pending job from the URL
+	queue := common.GetQueue(c.Params("queue"))
+	if queue == nil {
+		return c.Redirect("/admin/jobs?error=Queue not found")
+	}
+	jobId, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Invalid job ID")
+	}
+
+	// remove the job before it gets to run
+	err = queue.DeletePendingJob(jobId)
+	if err != nil {
+		return c.Redirect("/admin/jobs?error=Can't delete job: " + err.Error())
+	}
+
+	// redirect to the jobs page with a success message
+	return c.Redirect("/admin/jobs?success=Deleted job successfully")
+}
+
+func (m *AdminHandlers) get_settings(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// render the settings page, generated from the registered settings
+	return common.RenderTempl(c, settings_page(Messages{
+		Success: c.Query("success"),
+		Error:   c.Query("error"),
+	}, common.ListSettings()))
+}
+
+func (m *AdminHandlers) post_settings(c *fiber.Ctx) error {
+	// get session
+	sess, err := Store.Get(c)
+	if err != nil {
+		return c.Redirect("/admin/settings?error=Can't get session")
+	}
+
+	// redirect to the login page if the user is not logged in
+	userId := sess.Get("user_id")
+	if userId == nil {
+		return c.Redirect("/login?error=Please login to view the admin page")
+	}
+
+	// check if the user has the admin role
+	var count int
+	err = AuthDb.Get(&count, `SELECT COUNT(*) FROM user_roles WHERE user_id = ? AND role = "admin"`, userId.(int))
+	if err != nil {
+		return c.Redirect("/login?error=Can't get user roles")
+	}
+	if count == 0 {
+		return c.Redirect("/login?error=You do not have permission to view the admin page")
+	}
+
+	// save every setting of the form, unchecked checkboxes aren't sent so bools are read as "on" or missing
+	var errs []string
+	for _, setting := range common.ListSettings() {
+		value := c.FormValue(setting.Key)
+		if setting.Type == "bool" {
+			value = strconv.FormatBool(value != "")
+		}
+		if err := common.SetSetting(setting.Key, value); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return c.Redirect("/admin/settings?error=Can't save settings: " + strings.Join(errs, "; "))
+	}
+
+	// redirect to the settings page with a success message
+	return c.Redirect("/admin/settings?success=Saved settings successfully")
+}
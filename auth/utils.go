@@ -22,3 +22,12 @@ func IsLoggedIn(c *fiber.Ctx) (int, error) {
 
 	return userId.(int), nil
 }
+
+// Checks a new password against the password policy (see PasswordMinLength).
+// Returns the message to show the user, or an empty string if the password is fine.
+func checkPassword(password string) string {
+	if minLength := PasswordMinLength.Get(); len(password) < minLength {
+		return fmt.Sprintf("Password must be at least %d characters", minLength)
+	}
+	return ""
+}
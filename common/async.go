@@ -1,35 +1,288 @@
 package common
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Error returned in place of the result of a function that panicked, so a panic in a goroutine
+// started by Async or a combinator fails the call instead of crashing the whole process.
+type PanicError struct {
+	Value any    // Value passed to panic.
+	Stack []byte // Stack trace of the goroutine that panicked.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n\n%s", e.Value, e.Stack)
+}
+
+// Returns the value passed to panic if it's an error, so errors.Is and errors.As see through the panic.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// Calls fn, turning a panic into a *PanicError.
+func safeCall[T any](ctx context.Context, fn func(ctx context.Context) (T, error)) (res T, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return fn(ctx)
+}
+
+// The result of a function running in the background, see Async.
+// It can be waited on any number of times, from any number of goroutines.
 type Promise[T any] struct {
-	ResultCh chan T
-	ErrorCh  chan error
+	state *promiseState[T]
 }
 
+type promiseState[T any] struct {
+	done chan struct{} // Closed once res and err are set.
+	res  T
+	err  error
+}
+
+// Waits for the function to return and returns its result.
 func (p Promise[T]) Wait() (T, error) {
-	err := <-p.ErrorCh
-	res := <-p.ResultCh
+	<-p.state.done
+	return p.state.res, p.state.err
+}
 
-	return res, err
+// Waits for the function to return, or for ctx to be done. In the latter case,
+// the context's error is returned and the function keeps running.
+func (p Promise[T]) WaitContext(ctx context.Context) (T, error) {
+	select {
+	case <-p.state.done:
+		return p.state.res, p.state.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
 }
 
-func (p Promise[T]) Close() {
-	close(p.ErrorCh)
-	close(p.ResultCh)
+// Waits for the function to return for at most timeout. If it takes longer,
+// context.DeadlineExceeded is returned and the function keeps running.
+func (p Promise[T]) WaitTimeout(timeout time.Duration) (T, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return p.WaitContext(ctx)
 }
 
-func Async[T any](fn func() (T, error)) Promise[T] {
-	p := Promise[T]{
-		ResultCh: make(chan T, 1),
-		ErrorCh:  make(chan error, 1),
+// Whether the function returned.
+func (p Promise[T]) Done() bool {
+	select {
+	case <-p.state.done:
+		return true
+	default:
+		return false
 	}
+}
 
+// Runs fn in a goroutine and returns a promise of its result. fn gets ctx and should
+// stop when it's done. If fn panics, the promise fails with a *PanicError.
+func Async[T any](ctx context.Context, fn func(ctx context.Context) (T, error)) Promise[T] {
+	p := Promise[T]{state: &promiseState[T]{done: make(chan struct{})}}
 	go func() {
-		defer p.Close()
-
-		res, err := fn()
-		p.ResultCh <- res
-		p.ErrorCh <- err
+		defer close(p.state.done)
+		p.state.res, p.state.err = safeCall(ctx, fn)
 	}()
-
 	return p
 }
+
+// The combinators below run tasks concurrently and wait for all of them to return
+// before returning, so no goroutine outlives the call. Tasks get a context that is
+// canceled when their result isn't needed anymore (i.e. a sibling task failed),
+// they should pass it on to the database or HTTP calls they make. A task that panics
+// fails with a *PanicError.
+
+// A task run by the combinators.
+type Task[T any] func(ctx context.Context) (T, error)
+
+// Outcome of a task run by AllSettled.
+type Settled[T any] struct {
+	Value T
+	Err   error
+}
+
+// Runs the tasks concurrently and returns their results, in the same order.
+// The first error cancels the other tasks and is returned.
+func All[T any](ctx context.Context, tasks ...Task[T]) ([]T, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]T, len(tasks))
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		i, task := i, task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := safeCall(ctx, task)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+				return
+			}
+			results[i] = res
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
+
+// Runs the tasks concurrently and returns all their outcomes, in the same order.
+// Failing tasks don't cancel the others.
+func AllSettled[T any](ctx context.Context, tasks ...Task[T]) []Settled[T] {
+	results := make([]Settled[T], len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		i, task := i, task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := safeCall(ctx, task)
+			results[i] = Settled[T]{Value: res, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Runs the tasks concurrently and returns the outcome of the first one to return,
+// whether it succeeded or not. The other tasks are canceled.
+func Race[T any](ctx context.Context, tasks ...Task[T]) (T, error) {
+	if len(tasks) == 0 {
+		var zero T
+		return zero, errors.New("race: no tasks")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outcomes := make(chan Settled[T], len(tasks))
+	var wg sync.WaitGroup
+	for _, task := range tasks {
+		task := task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := safeCall(ctx, task)
+			outcomes <- Settled[T]{Value: res, Err: err}
+		}()
+	}
+	first := <-outcomes
+	cancel()
+	wg.Wait()
+	return first.Value, first.Err
+}
+
+// Runs the tasks concurrently and returns the result of the first one to succeed.
+// The other tasks are canceled. If every task fails, their errors are joined.
+func Any[T any](ctx context.Context, tasks ...Task[T]) (T, error) {
+	if len(tasks) == 0 {
+		var zero T
+		return zero, errors.New("any: no tasks")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type outcome struct {
+		Settled[T]
+		index int
+	}
+	outcomes := make(chan outcome, len(tasks))
+	var wg sync.WaitGroup
+	for i, task := range tasks {
+		i, task := i, task
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := safeCall(ctx, task)
+			outcomes <- outcome{Settled[T]{Value: res, Err: err}, i}
+		}()
+	}
+
+	errs := make([]error, len(tasks))
+	for range tasks {
+		o := <-outcomes
+		if o.Err == nil {
+			cancel()
+			wg.Wait()
+			return o.Value, nil
+		}
+		errs[o.index] = o.Err
+	}
+	var zero T
+	return zero, errors.Join(errs...)
+}
+
+// Wraps the tasks so at most limit of them run at the same time, i.e. All(ctx, WithLimit(4, tasks...)...).
+// Tasks waiting for their turn return the context's error if it's canceled. A limit <= 0 means no limit.
+func WithLimit[T any](limit int, tasks ...Task[T]) []Task[T] {
+	if limit <= 0 {
+		return tasks
+	}
+	sem := make(chan struct{}, limit)
+	limited := make([]Task[T], len(tasks))
+	for i, task := range tasks {
+		task := task
+		limited[i] = func(ctx context.Context) (T, error) {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				var zero T
+				return zero, ctx.Err()
+			}
+			defer func() { <-sem }()
+			return task(ctx)
+		}
+	}
+	return limited
+}
+
+// Calls fn for every item, with at most limit calls at the same time (no limit if <= 0),
+// and returns the results in the same order. The first error cancels the other calls and is returned.
+func Map[In, Out any](ctx context.Context, items []In, limit int, fn func(ctx context.Context, item In) (Out, error)) ([]Out, error) {
+	tasks := make([]Task[Out], len(items))
+	for i, item := range items {
+		item := item
+		tasks[i] = func(ctx context.Context) (Out, error) {
+			return fn(ctx, item)
+		}
+	}
+	return All(ctx, WithLimit(limit, tasks...)...)
+}
+
+// Runs tasks of different types concurrently, each one storing its result in a variable
+// of the caller. The first error cancels the other tasks and is returned.
+//
+//	var users []User
+//	var codes []SignupCode
+//	err := common.Parallel(ctx,
+//		func(ctx context.Context) error { return db.SelectContext(ctx, &users, "...") },
+//		func(ctx context.Context) error { return db.SelectContext(ctx, &codes, "...") },
+//	)
+func Parallel(ctx context.Context, tasks ...func(ctx context.Context) error) error {
+	wrapped := make([]Task[struct{}], len(tasks))
+	for i, task := range tasks {
+		task := task
+		wrapped[i] = func(ctx context.Context) (struct{}, error) {
+			return struct{}{}, task(ctx)
+		}
+	}
+	_, err := All(ctx, wrapped...)
+	return err
+}
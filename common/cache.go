@@ -1,9 +1,12 @@
 package common
 
 import (
-	"encoding/json"
+	"container/heap"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,73 +21,323 @@ func CacheKey(key string, args ...interface{}) string {
 	return result
 }
 
+// A key/value store for cached values. Keys can be tagged when they're set,
+// to delete them together later with InvalidateTag.
 type ICacheStore interface {
 	Get(key string) ([]byte, error)
-	Set(key string, val []byte, exp time.Duration) error
+	Set(key string, val []byte, exp time.Duration, tags ...string) error
+	Delete(key string) error
+	DeleteByPrefix(prefix string) error // i.e. DeleteByPrefix(CacheKey("user", id) + ":")
+	InvalidateTag(tag string) error     // Deletes every key set with the tag.
+	Clear() error                       // Deletes every key.
 }
 
-func Remember[T any](store ICacheStore, key string, duration time.Duration, fn func() (T, error)) (T, error) {
-	cached, err := store.Get(key)
-	if err == nil && cached != nil && len(cached) > 0 {
-		var result T
-		if err := json.Unmarshal(cached, &result); err != nil {
-			return result, err
-		}
-		return result, nil
-	}
+// Tells a bounded CacheStore which key to evict when it's full.
+type EvictionPolicy int
 
-	result, err := fn()
-	if err != nil {
-		return result, err
-	}
+const (
+	EvictLRU EvictionPolicy = iota // Evicts the least recently used key.
+	EvictLFU                       // Evicts the least frequently used key, then the least recently used one.
+)
 
-	computed, err := json.Marshal(result)
-	if err != nil {
-		return result, err
-	}
-	store.Set(key, computed, duration)
-	return result, nil
+type CacheStoreOptions struct {
+	JanitorInterval time.Duration  // How often expired keys are evicted. Default: 1 minute (negative to disable)
+	MaxEntries      int            // Max number of keys. Default: unbounded
+	MaxBytes        int64          // Max size of the keys and values. Default: unbounded
+	Eviction        EvictionPolicy // Which key to evict when a bound is reached. Default: EvictLRU
 }
 
-func NewCacheStore() *CacheStore {
-	return &CacheStore{
-		kV:       make(map[string][]byte),
-		expiries: make(map[string]time.Time),
+// Counters of a CacheStore, see CacheStore.Stats.
+type CacheStats struct {
+	Entries     int    // Keys in the store, including expired ones not evicted yet.
+	Bytes       int64  // Size of the keys and values in the store.
+	Hits        uint64 // Gets that found a key.
+	Misses      uint64 // Gets that found no key or an expired one.
+	Evictions   uint64 // Keys evicted to respect MaxEntries or MaxBytes.
+	Expirations uint64 // Expired keys evicted.
+}
+
+// Creates a new in-memory cache store, safe for concurrent use.
+// Expired keys are evicted when they're read and by a janitor goroutine running
+// every JanitorInterval, call Close to stop it when the store isn't needed anymore.
+// When MaxEntries or MaxBytes is set, the store is bounded: setting a key evicts other
+// keys (according to the eviction policy) until it fits, and a value that can't fit
+// even in an empty store is rejected.
+func NewCacheStore(options CacheStoreOptions) *CacheStore {
+	if options.JanitorInterval == 0 {
+		options.JanitorInterval = time.Minute
+	}
+
+	c := &CacheStore{
+		entries:    make(map[string]*cacheEntry),
+		tags:       make(map[string]map[string]struct{}),
+		maxEntries: options.MaxEntries,
+		maxBytes:   options.MaxBytes,
+		stop:       make(chan struct{}),
+	}
+	if options.MaxEntries > 0 || options.MaxBytes > 0 {
+		c.order = &cacheOrder{lfu: options.Eviction == EvictLFU}
 	}
+	if options.JanitorInterval > 0 {
+		go c.janitor(options.JanitorInterval)
+	}
+	return c
 }
 
 type CacheStore struct {
-	kV       map[string][]byte
-	expiries map[string]time.Time
+	mu         sync.RWMutex // Guards entries, tags, order, bytes and seq.
+	entries    map[string]*cacheEntry
+	tags       map[string]map[string]struct{} // Keys set with each tag.
+	order      *cacheOrder                    // Eviction order of the keys. (nil if the store is unbounded)
+	bytes      int64
+	seq        uint64 // Incremented on every access, tells which key was used last.
+	maxEntries int
+	maxBytes   int64
+	stop       chan struct{} // Closed to stop the janitor.
+	stopOnce   sync.Once
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+}
+
+type cacheEntry struct {
+	key     string
+	val     []byte
+	tags    []string
+	expiry  time.Time // Zero if the key doesn't expire.
+	hits    uint64    // Number of times the key was read, for EvictLFU.
+	lastUse uint64    // Value of seq when the key was last used.
+	index   int       // Position in order.
+}
+
+// Size of an entry counted against MaxBytes.
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.key) + len(e.val))
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && now.After(e.expiry)
 }
 
 func (c *CacheStore) Get(key string) ([]byte, error) {
-	val, ok := c.kV[key]
+	if c.order == nil {
+		// Unbounded stores don't track usage, reads can share the lock.
+		c.mu.RLock()
+		entry, ok := c.entries[key]
+		c.mu.RUnlock()
+		if ok && !entry.expired(time.Now()) {
+			c.hits.Add(1)
+			return entry.val, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
 	if !ok {
+		c.misses.Add(1)
 		return nil, errors.New("key not found")
 	}
-
-	expiry, exists := c.expiries[key]
-	if exists && time.Now().After(expiry) {
-		c.Delete(key)
+	if entry.expired(time.Now()) {
+		c.remove(entry)
+		c.expirations.Add(1)
+		c.misses.Add(1)
 		return nil, errors.New("key expired")
 	}
-
-	return val, nil
+	entry.hits++ // Before touch, EvictLFU orders the keys by hits.
+	c.touch(entry)
+	c.hits.Add(1)
+	return entry.val, nil
 }
 
-func (c *CacheStore) Set(key string, val []byte, exp time.Duration) error {
-	c.kV[key] = val
+func (c *CacheStore) Set(key string, val []byte, exp time.Duration, tags ...string) error {
+	entry := &cacheEntry{key: key, val: val, tags: tags}
 	if exp > 0 {
-		c.expiries[key] = time.Now().Add(exp)
-	} else {
-		delete(c.expiries, key)
+		entry.expiry = time.Now().Add(exp)
+	}
+	if c.maxBytes > 0 && entry.size() > c.maxBytes {
+		return fmt.Errorf("can't cache key %s: %d bytes is more than the store can hold (%d bytes)", key, entry.size(), c.maxBytes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		entry.hits = old.hits // Keep the key's popularity for EvictLFU.
+		c.remove(old)
+	}
+	c.seq++
+	entry.lastUse = c.seq
+	if c.order != nil {
+		c.makeRoom(entry.size())
+		heap.Push(c.order, entry)
+	}
+	c.entries[key] = entry
+	c.bytes += entry.size()
+	for _, tag := range tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = make(map[string]struct{})
+		}
+		c.tags[tag][key] = struct{}{}
 	}
 	return nil
 }
 
 func (c *CacheStore) Delete(key string) error {
-	delete(c.kV, key)
-	delete(c.expiries, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok {
+		c.remove(entry)
+	}
+	return nil
+}
+
+func (c *CacheStore) DeleteByPrefix(prefix string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(entry)
+		}
+	}
+	return nil
+}
+
+func (c *CacheStore) InvalidateTag(tag string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.tags[tag] {
+		c.remove(c.entries[key])
+	}
+	return nil
+}
+
+func (c *CacheStore) Clear() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+	c.tags = make(map[string]map[string]struct{})
+	if c.order != nil {
+		c.order.entries = nil
+	}
+	c.bytes = 0
+	return nil
+}
+
+// Returns the counters of the store.
+func (c *CacheStore) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return CacheStats{
+		Entries:     len(c.entries),
+		Bytes:       c.bytes,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Evictions:   c.evictions.Load(),
+		Expirations: c.expirations.Load(),
+	}
+}
+
+// Marks an entry as just used, the caller must hold the write lock.
+func (c *CacheStore) touch(entry *cacheEntry) {
+	c.seq++
+	entry.lastUse = c.seq
+	if c.order != nil {
+		heap.Fix(c.order, entry.index)
+	}
+}
+
+// Removes an entry, the caller must hold the write lock.
+func (c *CacheStore) remove(entry *cacheEntry) {
+	delete(c.entries, entry.key)
+	c.bytes -= entry.size()
+	for _, tag := range entry.tags {
+		delete(c.tags[tag], entry.key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+	if c.order != nil {
+		heap.Remove(c.order, entry.index)
+	}
+}
+
+// Evicts entries until a new one of the given size fits, the caller must hold the write lock.
+// It's done before adding the entry, otherwise EvictLFU would evict it right away.
+func (c *CacheStore) makeRoom(size int64) {
+	for len(c.entries) > 0 &&
+		((c.maxEntries > 0 && len(c.entries)+1 > c.maxEntries) || (c.maxBytes > 0 && c.bytes+size > c.maxBytes)) {
+		c.remove(c.order.entries[0])
+		c.evictions.Add(1)
+	}
+}
+
+// Stops the janitor. The store can still be used, expired keys are then only evicted when read.
+func (c *CacheStore) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
 	return nil
 }
+
+// Evicts expired keys every interval until the store is closed.
+func (c *CacheStore) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			c.removeExpired()
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Deletes every expired key, the caller must hold the write lock.
+func (c *CacheStore) removeExpired() {
+	now := time.Now()
+	for _, entry := range c.entries {
+		if entry.expired(now) {
+			c.remove(entry)
+			c.expirations.Add(1)
+		}
+	}
+}
+
+// Min-heap of the entries of a bounded store, the next one to evict first.
+type cacheOrder struct {
+	entries []*cacheEntry
+	lfu     bool
+}
+
+func (o *cacheOrder) Len() int { return len(o.entries) }
+
+func (o *cacheOrder) Less(i, j int) bool {
+	a, b := o.entries[i], o.entries[j]
+	if o.lfu && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.lastUse < b.lastUse
+}
+
+func (o *cacheOrder) Swap(i, j int) {
+	o.entries[i], o.entries[j] = o.entries[j], o.entries[i]
+	o.entries[i].index = i
+	o.entries[j].index = j
+}
+
+func (o *cacheOrder) Push(x any) {
+	entry := x.(*cacheEntry)
+	entry.index = len(o.entries)
+	o.entries = append(o.entries, entry)
+}
+
+func (o *cacheOrder) Pop() any {
+	last := o.entries[len(o.entries)-1]
+	o.entries = o.entries[:len(o.entries)-1]
+	return last
+}
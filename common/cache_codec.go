@@ -0,0 +1,86 @@
+package common
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Serializes the values cached by Remember, see RememberOptions.Codec.
+type Codec interface {
+	Name() string // Stored with each entry, entries written with another codec are recomputed.
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	// Encodes values in JSON. Readable, but interface values come back as maps and float64
+	// (losing the precision of large integers).
+	JSONCodec Codec = jsonCodec{}
+	// Encodes values with encoding/gob. Keeps the Go types, faster for large structs.
+	// Concrete types stored in interface values must be registered with gob.Register.
+	GobCodec Codec = gobCodec{}
+	// Stores []byte and string values as they are, for values that are already encoded (i.e. rendered HTML).
+	RawCodec Codec = rawCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+type rawCodec struct{}
+
+func (rawCodec) Name() string {
+	return "raw"
+}
+
+func (rawCodec) Marshal(v any) ([]byte, error) {
+	switch v := v.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, fmt.Errorf("raw codec can't encode %T, only []byte and string", v)
+	}
+}
+
+func (rawCodec) Unmarshal(data []byte, v any) error {
+	switch v := v.(type) {
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+		return nil
+	case *string:
+		*v = string(data)
+		return nil
+	default:
+		return fmt.Errorf("raw codec can't decode into %T, only *[]byte and *string", v)
+	}
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// This file holds a Fiber middleware caching whole responses in an ICacheStore,
+// so pages that are the same for every visitor aren't rendered on every request.
+
+type ResponseCacheOptions struct {
+	Store         ICacheStore             // Where the responses are cached. Required
+	CacheOptions                          // How long responses are fresh, or served stale. Same defaults as SetCacheHeader
+	QueryParams   []string                // Query params telling responses apart, the others are ignored. Default: none
+	VaryHeaders   []string                // Request headers telling responses apart, also sent in the Vary header. Default: none
+	Tags          []string                // Tags of the cached responses, see ICacheStore.InvalidateTag.
+	SessionCookie string                  // Requests with this cookie (i.e. logged in users) aren't cached. Default: "session_id"
+	Skip          func(c *fiber.Ctx) bool // Requests it returns true for aren't cached. Default: none
+}
+
+// Returns a middleware caching the responses of GET and HEAD requests in options.Store.
+// Responses are keyed by method, path, options.QueryParams and options.VaryHeaders, and only
+// 200 responses without cookies or "Cache-Control: no-store/private" are cached.
+//
+// A cached response is served for MaxAge (with "X-Cache: HIT"). Then, for StaleWhileRevalidate,
+// the first request renders it again while the other ones get the stale response ("X-Cache: STALE").
+// If rendering fails (an error or a 5xx status), the stale response is served for StaleIfError.
+// Concurrent requests for a response that isn't cached wait for the first one to render it.
+// A MaxAge of 0 disables the cache.
+//
+// The handler should still call SetCacheHeader, the middleware caches the Cache-Control header with the response.
+func CacheResponses(options ResponseCacheOptions) fiber.Handler {
+	if options.Store == nil {
+		log.Fatalf("Error creating response cache: no store")
+	}
+	if options.MaxAge < 0 {
+		options.MaxAge = time.Hour
+	}
+	if options.StaleWhileRevalidate < 0 {
+		options.StaleWhileRevalidate = 5 * time.Minute
+	}
+	if options.StaleIfError < 0 {
+		options.StaleIfError = 5 * time.Minute
+	}
+	if options.SessionCookie == "" {
+		options.SessionCookie = "session_id"
+	}
+	ttl := options.MaxAge + max(options.StaleWhileRevalidate, options.StaleIfError)
+
+	return func(c *fiber.Ctx) error {
+		if options.MaxAge == 0 || (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) ||
+			c.Cookies(options.SessionCookie) != "" || (options.Skip != nil && options.Skip(c)) {
+			return c.Next()
+		}
+		for _, header := range options.VaryHeaders {
+			c.Vary(header)
+		}
+
+		key := responseCacheKey(c, options)
+		cached := loadResponse(options.Store, key)
+		now := time.Now()
+		if cached != nil && cached.age(now) < options.MaxAge {
+			return cached.send(c, "HIT")
+		}
+		if cached != nil && cached.age(now) < options.MaxAge+options.StaleWhileRevalidate &&
+			responseCalls.running(rememberKey{options.Store, key}) {
+			return cached.send(c, "STALE")
+		}
+
+		leader := false
+		var nextErr error
+		val, _ := responseCalls.do(rememberKey{options.Store, key}, func() (any, error) {
+			leader = true
+			nextErr = c.Next()
+			if nextErr != nil || !cacheableResponse(c) {
+				return nil, nil
+			}
+			response := captureResponse(c)
+			encoded, err := GobCodec.Marshal(response)
+			if err == nil {
+				err = options.Store.Set(key, encoded, ttl, options.Tags...)
+			}
+			if err != nil {
+				fmt.Printf("failed to cache response %s: %v\n", key, err)
+			}
+			return response, nil
+		})
+
+		if leader {
+			failed := nextErr != nil || c.Response().StatusCode() >= 500
+			if failed && cached != nil && cached.age(now) < options.MaxAge+options.StaleIfError {
+				c.Response().Reset()
+				return cached.send(c, "STALE")
+			}
+			if nextErr == nil {
+				c.Set("X-Cache", "MISS")
+			}
+			return nextErr
+		}
+		if response, ok := val.(*cachedResponse); ok {
+			return response.send(c, "HIT")
+		}
+		// The first request's response couldn't be cached, render this one.
+		return c.Next()
+	}
+}
+
+var responseCalls = callGroup{calls: make(map[any]*groupCall)}
+
+type cachedResponse struct {
+	Status   int
+	Headers  [][2]string
+	Body     []byte
+	StoredAt int64 // Unix milliseconds.
+}
+
+func (r *cachedResponse) age(now time.Time) time.Duration {
+	return now.Sub(time.UnixMilli(r.StoredAt))
+}
+
+func (r *cachedResponse) send(c *fiber.Ctx, state string) error {
+	for _, header := range r.Headers {
+		c.Set(header[0], header[1])
+	}
+	c.Set("X-Cache", state)
+	return c.Status(r.Status).Send(r.Body)
+}
+
+func responseCacheKey(c *fiber.Ctx, options ResponseCacheOptions) string {
+	args := []interface{}{c.Method(), c.Path()}
+	for _, param := range options.QueryParams {
+		args = append(args, param+"="+c.Query(param))
+	}
+	for _, header := range options.VaryHeaders {
+		args = append(args, header+"="+c.Get(header))
+	}
+	return CacheKey("response", args...)
+}
+
+// Returns the cached response, or nil if there's none (or it can't be decoded).
+func loadResponse(store ICacheStore, key string) *cachedResponse {
+	encoded, err := store.Get(key)
+	if err != nil || len(encoded) == 0 {
+		return nil
+	}
+	var response cachedResponse
+	if err := GobCodec.Unmarshal(encoded, &response); err != nil {
+		return nil
+	}
+	return &response
+}
+
+// Whether the response can be cached and served to other visitors.
+func cacheableResponse(c *fiber.Ctx) bool {
+	res := c.Response()
+	cacheControl := strings.ToLower(string(res.Header.Peek(fiber.HeaderCacheControl)))
+	return res.StatusCode() == fiber.StatusOK &&
+		!res.IsBodyStream() &&
+		len(res.Header.Peek(fiber.HeaderSetCookie)) == 0 &&
+		!strings.Contains(cacheControl, "no-store") &&
+		!strings.Contains(cacheControl, "private")
+}
+
+func captureResponse(c *fiber.Ctx) *cachedResponse {
+	res := c.Response()
+	response := &cachedResponse{
+		Status:   res.StatusCode(),
+		Body:     append([]byte(nil), res.Body()...),
+		StoredAt: time.Now().UnixMilli(),
+	}
+	res.Header.VisitAll(func(key, value []byte) {
+		switch string(key) {
+		case fiber.HeaderContentLength, fiber.HeaderDate, "X-Cache":
+			return
+		}
+		response.Headers = append(response.Headers, [2]string{string(key), string(value)})
+	})
+	return response
+}
@@ -0,0 +1,355 @@
+package common
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// This file holds Remember, which caches the result of a function in an ICacheStore.
+// Concurrent calls computing the same key of the same store are coalesced: only the first
+// one calls fn and the others wait for its result, so a cold cache doesn't fan out
+// the same expensive query for every request.
+// Errors can be cached too (see RememberOptions.NegativeTTL), so lookups of missing rows
+// don't hit the database every time.
+//
+// Entries start with a header telling the format, the codec and the version they were
+// written with. Entries that don't match the current ones are treated as misses and
+// overwritten, so changing any of them invalidates the old entries without breaking reads.
+// The header looks like this (lengths in bytes):
+//
+//	magic (1) | format (1) | kind (1) | fresh until, unix ms (8) | codec name length (1) | codec name | version length (1) | version | payload
+
+type RememberOptions struct {
+	TTL                  time.Duration // How long the value is fresh. Default: 0 (never expires)
+	StaleWhileRevalidate time.Duration // How long a stale value is still returned while it's recomputed in the background. Default: 0 (disabled)
+	Tags                 []string      // Tags of the key, see ICacheStore.InvalidateTag.
+	Codec                Codec         // Serializes the value. Default: JSONCodec
+	Version              string        // Change it when the type of the value changes, to invalidate the old entries.
+
+	NegativeTTL    time.Duration // How long an error returned by fn is cached. Default: 0 (errors aren't cached)
+	CacheErrors    []error       // Errors to cache, matched with errors.Is. Default: sql.ErrNoRows
+	CacheAllErrors bool          // Caches every error, not only CacheErrors.
+	NoCacheErrors  []error       // Errors never cached, even if they match CacheErrors or CacheAllErrors is set.
+}
+
+// Returned by Remember in place of an error of fn that was cached, see RememberOptions.NegativeTTL.
+// It wraps the matching error of CacheErrors, so errors.Is(err, sql.ErrNoRows) works like it did for the original error.
+type CachedError struct {
+	Err     error  // The matching error of CacheErrors. (nil if the error was cached because of CacheAllErrors)
+	Message string // Message of the original error.
+}
+
+func (e *CachedError) Error() string {
+	return e.Message
+}
+
+func (e *CachedError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the value cached at key, or calls fn and caches its result for duration
+// with the given tags. Errors returned by fn are not cached.
+func Remember[T any](store ICacheStore, key string, duration time.Duration, fn func() (T, error), tags ...string) (T, error) {
+	return RememberWithOptions(store, key, RememberOptions{TTL: duration, Tags: tags}, fn)
+}
+
+// Same as Remember, with more options.
+//
+// With NegativeTTL, errors returned by fn matching CacheErrors (or any error with CacheAllErrors)
+// are cached for NegativeTTL, and returned as a *CachedError until then.
+//
+// With StaleWhileRevalidate, the value is kept in the store for TTL + StaleWhileRevalidate.
+// Once it's older than TTL, it's still returned right away and fn is called in the background
+// to refresh it, like the stale-while-revalidate directive set by SetCacheHeader.
+func RememberWithOptions[T any](store ICacheStore, key string, options RememberOptions, fn func() (T, error)) (T, error) {
+	if options.Codec == nil {
+		options.Codec = JSONCodec
+	}
+
+	var result T
+	cached, err := store.Get(key)
+	if err != nil || len(cached) == 0 {
+		return rememberCall(store, key, options, fn)
+	}
+	entry, ok := decodeRememberEntry(cached, options)
+	if !ok {
+		return rememberCall(store, key, options, fn)
+	}
+
+	if entry.kind == rememberError {
+		cachedErr, ok := decodeCachedError(entry.payload, options)
+		if !ok {
+			// The error isn't cacheable anymore (i.e. CacheErrors changed), compute the value again.
+			return rememberCall(store, key, options, fn)
+		}
+		return result, cachedErr
+	}
+
+	err = options.Codec.Unmarshal(entry.payload, &result)
+	if err != nil {
+		log.Printf("failed to decode cache key %s, computing it again: %v", key, err)
+		return rememberCall(store, key, options, fn)
+	}
+	if options.StaleWhileRevalidate > 0 && entry.freshUntil > 0 && time.Now().UnixMilli() >= entry.freshUntil {
+		// The refresh is started before the goroutine runs, so other hits of the stale key don't start one too.
+		call, started := rememberCalls.begin(rememberKey{store, key})
+		if started {
+			go func() {
+				// Nothing recovers panics in this goroutine, they would crash the app.
+				defer func() {
+					if r := recover(); r != nil {
+						log.Printf("failed to refresh cache key %s: panic: %v\n%s", key, r, debug.Stack())
+					}
+				}()
+				_, err := rememberCalls.run(rememberKey{store, key}, call, rememberLoad(store, key, options, fn))
+				if err != nil {
+					log.Printf("failed to refresh cache key %s: %v", key, err)
+				}
+			}()
+		}
+	}
+	return result, nil
+}
+
+// Calls fn and caches its result, or waits for the result of a call already running for the same key.
+func rememberCall[T any](store ICacheStore, key string, options RememberOptions, fn func() (T, error)) (T, error) {
+	val, err := rememberCalls.do(rememberKey{store, key}, rememberLoad(store, key, options, fn))
+	result, ok := val.(T)
+	if !ok && val != nil {
+		// The running call was made with another type for the same key, don't share its result.
+		return fn()
+	}
+	return result, err
+}
+
+// Returns the call computing the value of key with fn and caching it.
+func rememberLoad[T any](store ICacheStore, key string, options RememberOptions, fn func() (T, error)) func() (any, error) {
+	return func() (any, error) {
+		result, err := fn()
+		if err != nil {
+			if options.NegativeTTL > 0 {
+				if payload, ok := encodeCachedError(err, options); ok {
+					entry := rememberEntry{kind: rememberError, payload: payload}
+					store.Set(key, entry.encode(options), options.NegativeTTL, options.Tags...)
+				}
+			}
+			return result, err
+		}
+
+		payload, err := options.Codec.Marshal(result)
+		if err != nil {
+			return result, err
+		}
+		entry := rememberEntry{kind: rememberValue, payload: payload}
+		exp := options.TTL
+		if options.StaleWhileRevalidate > 0 && options.TTL > 0 {
+			entry.freshUntil = time.Now().Add(options.TTL).UnixMilli()
+			exp = options.TTL + options.StaleWhileRevalidate
+		}
+		store.Set(key, entry.encode(options), exp, options.Tags...)
+		return result, nil
+	}
+}
+
+const (
+	rememberMagic  = 0xCA // Values encoded in JSON, like entries written before the header, never start with it.
+	rememberFormat = 1    // Bump it when the header or the payload of errors changes.
+)
+
+// Kinds of entries.
+const (
+	rememberValue = 0 // The payload is the value encoded with the codec.
+	rememberError = 1 // The payload is a cachedErrorEntry encoded in JSON.
+)
+
+type rememberEntry struct {
+	kind       byte
+	freshUntil int64 // Unix milliseconds, 0 if the value doesn't go stale.
+	payload    []byte
+}
+
+func (e rememberEntry) encode(options RememberOptions) []byte {
+	codec, version := rememberLabel(options.Codec.Name()), rememberLabel(options.Version)
+	buf := make([]byte, 0, 13+len(codec)+len(version)+len(e.payload))
+	buf = append(buf, rememberMagic, rememberFormat, e.kind)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.freshUntil))
+	buf = append(buf, byte(len(codec)))
+	buf = append(buf, codec...)
+	buf = append(buf, byte(len(version)))
+	buf = append(buf, version...)
+	return append(buf, e.payload...)
+}
+
+// Decodes an entry, as long as it was written with the current format, codec and version.
+func decodeRememberEntry(data []byte, options RememberOptions) (rememberEntry, bool) {
+	var entry rememberEntry
+	if len(data) < 13 || data[0] != rememberMagic || data[1] != rememberFormat {
+		return entry, false
+	}
+	entry.kind = data[2]
+	entry.freshUntil = int64(binary.BigEndian.Uint64(data[3:11]))
+	rest := data[11:]
+	for _, expected := range []string{rememberLabel(options.Codec.Name()), rememberLabel(options.Version)} {
+		if len(rest) < 1+int(rest[0]) || string(rest[1:1+int(rest[0])]) != expected {
+			return entry, false
+		}
+		rest = rest[1+int(rest[0]):]
+	}
+	entry.payload = rest
+	return entry, true
+}
+
+// Truncates a codec name or version to fit its length in a byte.
+func rememberLabel(label string) string {
+	if len(label) > 255 {
+		return label[:255]
+	}
+	return label
+}
+
+type cachedErrorEntry struct {
+	Message string `json:"message"`
+	Match   string `json:"match,omitempty"` // Message of the matching error of CacheErrors.
+}
+
+func cacheErrors(options RememberOptions) []error {
+	if options.CacheErrors == nil {
+		return []error{sql.ErrNoRows}
+	}
+	return options.CacheErrors
+}
+
+// Encodes err if it should be cached.
+func encodeCachedError(err error, options RememberOptions) ([]byte, bool) {
+	for _, noCache := range options.NoCacheErrors {
+		if errors.Is(err, noCache) {
+			return nil, false
+		}
+	}
+
+	entry := cachedErrorEntry{Message: err.Error()}
+	matched := false
+	for _, cache := range cacheErrors(options) {
+		if errors.Is(err, cache) {
+			entry.Match = cache.Error()
+			matched = true
+			break
+		}
+	}
+	if !matched && !options.CacheAllErrors {
+		return nil, false
+	}
+
+	encoded, jsonErr := json.Marshal(entry)
+	if jsonErr != nil {
+		return nil, false
+	}
+	return encoded, true
+}
+
+// Decodes a cached error, as long as it's still cacheable with the given options.
+func decodeCachedError(payload []byte, options RememberOptions) (*CachedError, bool) {
+	var entry cachedErrorEntry
+	if err := json.Unmarshal(payload, &entry); err != nil {
+		return nil, false
+	}
+	cachedErr := &CachedError{Message: entry.Message}
+	if entry.Match == "" && !options.CacheAllErrors {
+		return nil, false
+	}
+	if entry.Match != "" {
+		for _, cache := range cacheErrors(options) {
+			if cache.Error() == entry.Match {
+				cachedErr.Err = cache
+				break
+			}
+		}
+		if cachedErr.Err == nil {
+			return nil, false
+		}
+	}
+	for _, noCache := range options.NoCacheErrors {
+		if errors.Is(cachedErr, noCache) {
+			return nil, false
+		}
+	}
+	return cachedErr, true
+}
+
+// Identifies the calls to coalesce. Stores must be comparable, which pointers are.
+type rememberKey struct {
+	store ICacheStore
+	key   string
+}
+
+var rememberCalls = callGroup{calls: make(map[any]*groupCall)}
+
+// Runs a single call per key at a time, callers with the same key share its result.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[any]*groupCall
+}
+
+type groupCall struct {
+	done chan struct{} // Closed when the call returned.
+	val  any
+	err  error
+}
+
+// Calls fn, or waits for the call already running for key and returns its result.
+func (g *callGroup) do(key any, fn func() (any, error)) (any, error) {
+	call, started := g.begin(key)
+	if !started {
+		<-call.done
+		return call.val, call.err
+	}
+	return g.run(key, call, fn)
+}
+
+// Registers a call for key, or returns the one already running and false.
+func (g *callGroup) begin(key any) (*groupCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	call := &groupCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+// Runs fn for a call registered with begin and shares its result with the waiting callers.
+func (g *callGroup) run(key any, call *groupCall, fn func() (any, error)) (any, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			call.err = fmt.Errorf("panic: %v", r)
+			g.finish(key, call)
+			panic(r)
+		}
+		g.finish(key, call)
+	}()
+	call.val, call.err = fn()
+	return call.val, call.err
+}
+
+func (g *callGroup) finish(key any, call *groupCall) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// Whether a call is running for key.
+func (g *callGroup) running(key any) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.calls[key]
+	return ok
+}
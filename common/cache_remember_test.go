@@ -0,0 +1,166 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Concurrent misses of a key call fn once and share its result.
+func TestRememberCoalescesMisses(t *testing.T) {
+	store := NewCacheStore(CacheStoreOptions{})
+	defer store.Close()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		calls.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make(chan int, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err := Remember(store, "coalesced", time.Minute, fn)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- val
+		}()
+	}
+	waitFor(t, "the call to start", func() bool { return calls.Load() == 1 })
+	time.Sleep(20 * time.Millisecond) // Let the other callers miss too.
+	close(release)
+	wg.Wait()
+	close(results)
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fn was called %d times, want 1", got)
+	}
+	for val := range results {
+		if val != 42 {
+			t.Fatalf("got %d, want 42", val)
+		}
+	}
+}
+
+// A stale value is returned right away and refreshed once in the background.
+func TestRememberStaleWhileRevalidate(t *testing.T) {
+	store := NewCacheStore(CacheStoreOptions{})
+	defer store.Close()
+	options := RememberOptions{TTL: 100 * time.Millisecond, StaleWhileRevalidate: time.Minute}
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fn := func() (int, error) {
+		n := calls.Add(1)
+		if n > 1 {
+			<-release
+		}
+		return int(n), nil
+	}
+	remember := func() int {
+		t.Helper()
+		val, err := RememberWithOptions(store, "stale", options, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+
+	if val := remember(); val != 1 {
+		t.Fatalf("got %d, want 1", val)
+	}
+	time.Sleep(120 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		if val := remember(); val != 1 {
+			t.Fatalf("got %d while refreshing, want the stale value", val)
+		}
+	}
+	close(release)
+	waitFor(t, "the refreshed value", func() bool { return remember() != 1 })
+	time.Sleep(20 * time.Millisecond) // Leave time for duplicate refreshes to run.
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("fn was called %d times, want 2", got)
+	}
+}
+
+// Missing rows are cached for NegativeTTL and still match sql.ErrNoRows.
+func TestRememberNegativeCaching(t *testing.T) {
+	store := NewCacheStore(CacheStoreOptions{})
+	defer store.Close()
+	options := RememberOptions{TTL: time.Minute, NegativeTTL: 50 * time.Millisecond}
+	var calls atomic.Int32
+	fn := func() (string, error) {
+		calls.Add(1)
+		return "", sql.ErrNoRows
+	}
+
+	_, err := RememberWithOptions(store, "missing", options, fn)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+	_, err = RememberWithOptions(store, "missing", options, fn)
+	var cached *CachedError
+	if !errors.As(err, &cached) || !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got %v, want a cached sql.ErrNoRows", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("fn was called %d times, want 1", got)
+	}
+
+	// Other errors aren't cached.
+	boom := errors.New("boom")
+	for i := 0; i < 2; i++ {
+		_, err = RememberWithOptions(store, "failing", options, func() (string, error) {
+			calls.Add(1)
+			return "", boom
+		})
+		if err != boom {
+			t.Fatalf("got %v, want the error of fn", err)
+		}
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("fn was called %d times, want 3", got)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	RememberWithOptions(store, "missing", options, fn)
+	if got := calls.Load(); got != 4 {
+		t.Fatalf("fn was called %d times after NegativeTTL, want 4", got)
+	}
+}
+
+// A panic in the background refresh of a stale value must not crash the app.
+func TestRememberRefreshPanic(t *testing.T) {
+	store := NewCacheStore(CacheStoreOptions{})
+	defer store.Close()
+	options := RememberOptions{TTL: 20 * time.Millisecond, StaleWhileRevalidate: time.Minute}
+	remember := func(fn func() (int, error)) int {
+		t.Helper()
+		val, err := RememberWithOptions(store, "refresh-panic", options, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+
+	remember(func() (int, error) { return 1, nil })
+	time.Sleep(30 * time.Millisecond)
+	if val := remember(func() (int, error) { panic("boom") }); val != 1 {
+		t.Fatalf("got %d, want the stale value", val)
+	}
+	waitFor(t, "the refresh to end", func() bool { return !rememberCalls.running(rememberKey{store, "refresh-panic"}) })
+
+	// The key is refreshed again once fn works.
+	remember(func() (int, error) { return 2, nil })
+	waitFor(t, "the refreshed value", func() bool {
+		return remember(func() (int, error) { return 2, nil }) == 2
+	})
+}
@@ -0,0 +1,266 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// This file holds a cache store backed by SQLite, so cached values survive restarts and deploys.
+// Keys live in a cache_entries table, expires_at is stored as unix milliseconds (0 if the key
+// doesn't expire), and the tags of each key in cache_tags. Expired rows are deleted
+// when they're read and by a vacuum goroutine.
+// It's slower than the in-memory CacheStore, use it on its own or as the L2 tier behind it.
+
+type SQLiteCacheStoreOptions struct {
+	Db             *sqlx.DB      // Database holding the cache_entries table. Required
+	VacuumInterval time.Duration // How often expired rows are deleted. Default: 10 minutes (negative to disable)
+}
+
+// Creates a new cache store persisted in options.Db, safe for concurrent use.
+// Call Close to stop the vacuum goroutine when the store isn't needed anymore.
+func NewSQLiteCacheStore(options SQLiteCacheStoreOptions) *SQLiteCacheStore {
+	if options.Db == nil {
+		log.Fatalf("Error creating cache store: no database")
+	}
+	if options.VacuumInterval == 0 {
+		options.VacuumInterval = 10 * time.Minute
+	}
+
+	err := createCacheTables(options.Db)
+	if err != nil {
+		log.Fatalf("Error creating cache tables: %v", err)
+	}
+
+	c := &SQLiteCacheStore{
+		Db:   options.Db,
+		stop: make(chan struct{}),
+	}
+	if options.VacuumInterval > 0 {
+		go c.vacuum(options.VacuumInterval)
+	}
+	return c
+}
+
+type SQLiteCacheStore struct {
+	Db       *sqlx.DB
+	stop     chan struct{} // Closed to stop the vacuum goroutine.
+	stopOnce sync.Once
+
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	expirations atomic.Uint64
+}
+
+func createCacheTables(db *sqlx.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS cache_entries (
+		key TEXT PRIMARY KEY,
+		value BLOB NOT NULL,
+		expires_at INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_cache_entries_expires_at ON cache_entries (expires_at)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS cache_tags (
+		tag TEXT NOT NULL,
+		key TEXT NOT NULL,
+		PRIMARY KEY (tag, key)
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_cache_tags_key ON cache_tags (key)`)
+	return err
+}
+
+func (c *SQLiteCacheStore) Get(key string) ([]byte, error) {
+	var row struct {
+		Value     []byte `db:"value"`
+		ExpiresAt int64  `db:"expires_at"`
+	}
+	err := c.Db.Get(&row, "SELECT value, expires_at FROM cache_entries WHERE key = ?", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.misses.Add(1)
+		return nil, errors.New("key not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	if row.ExpiresAt > 0 && row.ExpiresAt < now {
+		// Only delete the row if it wasn't set again in the meantime, its tags are deleted by the vacuum.
+		_, err = c.Db.Exec("DELETE FROM cache_entries WHERE key = ? AND expires_at > 0 AND expires_at < ?", key, now)
+		if err != nil {
+			return nil, err
+		}
+		c.expirations.Add(1)
+		c.misses.Add(1)
+		return nil, errors.New("key expired")
+	}
+	c.hits.Add(1)
+	return row.Value, nil
+}
+
+func (c *SQLiteCacheStore) Set(key string, val []byte, exp time.Duration, tags ...string) error {
+	var expiresAt int64
+	if exp > 0 {
+		expiresAt = time.Now().Add(exp).UnixMilli()
+	}
+	if val == nil {
+		val = []byte{} // value is NOT NULL
+	}
+
+	tx, err := c.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO cache_entries (key, value, expires_at) VALUES (?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at, updated_at = CURRENT_TIMESTAMP`,
+		key, val, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	// the key replaces its previous tags
+	_, err = tx.Exec("DELETE FROM cache_tags WHERE key = ?", key)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		_, err = tx.Exec("INSERT OR IGNORE INTO cache_tags (tag, key) VALUES (?, ?)", tag, key)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (c *SQLiteCacheStore) Delete(key string) error {
+	return c.deleteWhere("key = ?", key)
+}
+
+func (c *SQLiteCacheStore) DeleteByPrefix(prefix string) error {
+	// substr rather than LIKE, which would need the prefix to be escaped and ignores case
+	return c.deleteWhere("substr(key, 1, ?) = ?", len(prefix), prefix)
+}
+
+func (c *SQLiteCacheStore) InvalidateTag(tag string) error {
+	return c.deleteWhere("key IN (SELECT key FROM cache_tags WHERE tag = ?)", tag)
+}
+
+func (c *SQLiteCacheStore) Clear() error {
+	return c.deleteWhere("1 = 1")
+}
+
+// Deletes the keys matching the condition, and their tags.
+func (c *SQLiteCacheStore) deleteWhere(condition string, args ...any) error {
+	tx, err := c.Db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM cache_entries WHERE "+condition, args...)
+	if err != nil {
+		return err
+	}
+	// the condition may select keys by tag, so the tags go once the keys are deleted
+	_, err = tx.Exec("DELETE FROM cache_tags WHERE key NOT IN (SELECT key FROM cache_entries)")
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the tags the key was set with.
+func (c *SQLiteCacheStore) Tags(key string) ([]string, error) {
+	tags := []string{}
+	err := c.Db.Select(&tags, "SELECT tag FROM cache_tags WHERE key = ? ORDER BY tag", key)
+	return tags, err
+}
+
+// Returns the counters of the store. Hits, misses and expirations are counted
+// by this process since the store was created, Entries and Bytes are read from the table.
+func (c *SQLiteCacheStore) Stats() (CacheStats, error) {
+	var row struct {
+		Entries int   `db:"entries"`
+		Bytes   int64 `db:"bytes"`
+	}
+	err := c.Db.Get(&row, "SELECT COUNT(*) AS entries, COALESCE(SUM(LENGTH(key) + LENGTH(value)), 0) AS bytes FROM cache_entries")
+	if err != nil {
+		return CacheStats{}, err
+	}
+	return CacheStats{
+		Entries:     row.Entries,
+		Bytes:       row.Bytes,
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Expirations: c.expirations.Load(),
+	}, nil
+}
+
+// Deletes every expired row, and the tags of deleted keys. Returns how many keys were deleted.
+func (c *SQLiteCacheStore) Vacuum() (int64, error) {
+	result, err := c.Db.Exec("DELETE FROM cache_entries WHERE expires_at > 0 AND expires_at < ?", time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	c.expirations.Add(uint64(deleted))
+
+	_, err = c.Db.Exec("DELETE FROM cache_tags WHERE key NOT IN (SELECT key FROM cache_entries)")
+	if err != nil {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// Stops the vacuum goroutine. The store can still be used, expired rows are then only deleted when read.
+// The database isn't closed, it's owned by the caller.
+func (c *SQLiteCacheStore) Close() error {
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	return nil
+}
+
+// Deletes expired rows every interval until the store is closed.
+func (c *SQLiteCacheStore) vacuum(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			_, err := c.Vacuum()
+			if err != nil {
+				fmt.Printf("failed to vacuum cache entries: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The init functions of the package open its databases in ./db, and they run before TestMain.
+// So the tests move to a temporary directory holding a db directory while the package variables
+// are initialized (the only thing that runs before the init functions), and TestMain removes it.
+var testDir, testWd = enterTempDir()
+
+func enterTempDir() (dir, wd string) {
+	wd, err := os.Getwd()
+	if err == nil {
+		dir, err = os.MkdirTemp("", "common-test")
+	}
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dir, "db"), 0o755)
+	}
+	if err == nil {
+		err = os.Chdir(dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return dir, wd
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	os.Chdir(testWd)
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+func TestCacheStoreEvictionOrder(t *testing.T) {
+	for name, policy := range map[string]EvictionPolicy{"LRU": EvictLRU, "LFU": EvictLFU} {
+		t.Run(name, func(t *testing.T) {
+			const size = 8
+			c := NewCacheStore(CacheStoreOptions{MaxEntries: size, Eviction: policy, JanitorInterval: -1})
+			defer c.Close()
+
+			// Reference model: the key to evict has the fewest hits (EvictLFU only), then the oldest use.
+			type use struct{ hits, last int }
+			model := map[string]*use{}
+			evictedFirst := func(a, b *use) bool {
+				if policy == EvictLFU && a.hits != b.hits {
+					return a.hits < b.hits
+				}
+				return a.last < b.last
+			}
+			victim := func() string {
+				var key string
+				for k, u := range model {
+					if key == "" || evictedFirst(u, model[key]) {
+						key = k
+					}
+				}
+				return key
+			}
+
+			r := rand.New(rand.NewSource(1))
+			for step := 1; step <= 2000; step++ {
+				key := fmt.Sprintf("key-%d", r.Intn(2*size))
+				u, cached := model[key]
+
+				if r.Intn(3) > 0 {
+					_, err := c.Get(key)
+					if cached {
+						if err != nil {
+							t.Fatalf("step %d: Get(%s) = %v, want a hit", step, key, err)
+						}
+						u.hits++
+						u.last = step
+					}
+					continue
+				}
+
+				evicted := ""
+				if !cached && len(model) == size {
+					evicted = victim()
+					delete(model, evicted)
+				}
+				if err := c.Set(key, []byte("v"), 0); err != nil {
+					t.Fatal(err)
+				}
+				if cached {
+					u.last = step // Set keeps the hits of the key.
+				} else {
+					model[key] = &use{last: step}
+				}
+				if _, ok := c.entries[evicted]; evicted != "" && ok {
+					t.Fatalf("step %d: adding %s should have evicted %s", step, key, evicted)
+				}
+			}
+		})
+	}
+}
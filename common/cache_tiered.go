@@ -0,0 +1,127 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+type TieredCacheStoreOptions struct {
+	L1    ICacheStore   // Fast store read first. Default: an unbounded in-memory CacheStore
+	L2    ICacheStore   // Slower store read on L1 misses, i.e. a SQLiteCacheStore. Required
+	L1TTL time.Duration // Max time a key stays in L1. Default: 1 minute
+}
+
+// Creates a cache store reading through a fast L1 store (usually in memory) and
+// falling back to a slower, persistent L2 store. Keys are written and deleted in both,
+// and a key found in L2 only is copied to L1 (with its tags, if L2 can tell them like
+// SQLiteCacheStore does). A key stays in L1 for L1TTL at most, so changes made
+// to L2 by other processes show up after L1TTL, and an L2 key may be served from L1 for
+// up to L1TTL after it expired.
+func NewTieredCacheStore(options TieredCacheStoreOptions) *TieredCacheStore {
+	if options.L2 == nil {
+		log.Fatalf("Error creating cache store: no L2 store")
+	}
+	if options.L1 == nil {
+		options.L1 = NewCacheStore(CacheStoreOptions{})
+	}
+	if options.L1TTL <= 0 {
+		options.L1TTL = time.Minute
+	}
+
+	return &TieredCacheStore{
+		L1:    options.L1,
+		L2:    options.L2,
+		L1TTL: options.L1TTL,
+	}
+}
+
+// Implemented by stores that can tell the tags of a key, like SQLiteCacheStore.
+type cacheTagger interface {
+	Tags(key string) ([]string, error)
+}
+
+type TieredCacheStore struct {
+	L1    ICacheStore
+	L2    ICacheStore
+	L1TTL time.Duration
+}
+
+func (c *TieredCacheStore) Get(key string) ([]byte, error) {
+	val, err := c.L1.Get(key)
+	if err == nil {
+		return val, nil
+	}
+
+	val, err = c.L2.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	if l2, ok := c.L2.(cacheTagger); ok {
+		tags, err = l2.Tags(key)
+		if err != nil {
+			// Without its tags, InvalidateTag would miss the L1 copy.
+			log.Printf("failed to get the tags of key %s: %v", key, err)
+			return val, nil
+		}
+	}
+	err = c.L1.Set(key, val, c.L1TTL, tags...)
+	if err != nil {
+		// L1 may reject the value (i.e. too big), it's still served from L2.
+		log.Printf("failed to copy key %s to L1: %v", key, err)
+	}
+	return val, nil
+}
+
+// Writes the key to L2, then to L1 for L1TTL (or exp if shorter). Only L2 errors are returned.
+func (c *TieredCacheStore) Set(key string, val []byte, exp time.Duration, tags ...string) error {
+	err := c.L2.Set(key, val, exp, tags...)
+	if err != nil {
+		return err
+	}
+
+	l1Exp := c.L1TTL
+	if exp > 0 && exp < l1Exp {
+		l1Exp = exp
+	}
+	err = c.L1.Set(key, val, l1Exp, tags...)
+	if err != nil {
+		// L1 may reject the value (i.e. too big), it's still served from L2.
+		// Drop the previous value from L1 so it isn't served instead.
+		log.Printf("failed to write key %s to L1: %v", key, err)
+		if err := c.L1.Delete(key); err != nil {
+			log.Printf("failed to delete key %s from L1: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Deletes the key from L2 first, so a concurrent Get can't copy it back to L1 once it's deleted
+// from there. The other deletions work the same way.
+func (c *TieredCacheStore) Delete(key string) error {
+	return errors.Join(c.L2.Delete(key), c.L1.Delete(key))
+}
+
+func (c *TieredCacheStore) DeleteByPrefix(prefix string) error {
+	return errors.Join(c.L2.DeleteByPrefix(prefix), c.L1.DeleteByPrefix(prefix))
+}
+
+func (c *TieredCacheStore) InvalidateTag(tag string) error {
+	return errors.Join(c.L2.InvalidateTag(tag), c.L1.InvalidateTag(tag))
+}
+
+func (c *TieredCacheStore) Clear() error {
+	return errors.Join(c.L2.Clear(), c.L1.Clear())
+}
+
+// Closes both stores, if they need it (i.e. to stop the janitor of a CacheStore).
+func (c *TieredCacheStore) Close() error {
+	var errs []error
+	for _, store := range []ICacheStore{c.L1, c.L2} {
+		if s, ok := store.(interface{ Close() error }); ok {
+			errs = append(errs, s.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
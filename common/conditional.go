@@ -0,0 +1,124 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// This file holds the validators of conditional requests (ETag and Last-Modified), so
+// browsers revalidating a page or a file they already have get an empty 304 response.
+
+// Returns an ETag for the body: a strong one, or a weak one (W/"...") for bodies that are
+// equivalent but not byte-for-byte identical (i.e. compressed differently).
+func ETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	return TernaryIf(weak, "W/"+etag, etag)
+}
+
+// Sets the ETag and Last-Modified headers (when given) and returns whether the request
+// already has this version, in which case the handler should reply with fiber.StatusNotModified:
+//
+//	if common.NotModified(c, etag, updatedAt) {
+//		return c.SendStatus(fiber.StatusNotModified)
+//	}
+//
+// Like in RFC 9110, If-None-Match is checked with a weak comparison, and If-Modified-Since
+// is ignored when If-None-Match is present.
+func NotModified(c *fiber.Ctx, etag string, lastModified time.Time) bool {
+	if etag != "" {
+		c.Set(fiber.HeaderETag, etag)
+	}
+	if !lastModified.IsZero() {
+		c.Set(fiber.HeaderLastModified, lastModified.UTC().Format(http.TimeFormat))
+	}
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		return false
+	}
+
+	if ifNoneMatch := c.Get(fiber.HeaderIfNoneMatch); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := c.Get(fiber.HeaderIfModifiedSince); ifModifiedSince != "" && !lastModified.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		// HTTP dates have no sub-second precision.
+		return err == nil && !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+type ConditionalOptions struct {
+	Weak bool                    // Whether the ETags are weak. Default: false (strong)
+	Skip func(c *fiber.Ctx) bool // Requests it returns true for are left alone. Default: none
+}
+
+// Returns a middleware adding an ETag to the 200 responses of GET and HEAD requests
+// (i.e. pages rendered with RenderTempl), and replying with an empty 304 when the request
+// already has it. Responses that already have an ETag or a Last-Modified header
+// (i.e. static files, see StaticValidators) and streamed responses are left alone.
+func ConditionalResponses(options ConditionalOptions) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if (c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead) || (options.Skip != nil && options.Skip(c)) {
+			return c.Next()
+		}
+		err := c.Next()
+		if err != nil {
+			return err
+		}
+
+		res := c.Response()
+		if res.StatusCode() != fiber.StatusOK || res.IsBodyStream() ||
+			len(res.Header.Peek(fiber.HeaderETag)) > 0 || len(res.Header.Peek(fiber.HeaderLastModified)) > 0 {
+			return nil
+		}
+		if NotModified(c, ETag(res.Body(), options.Weak), time.Time{}) {
+			res.ResetBody()
+			c.Status(fiber.StatusNotModified)
+		}
+		return nil
+	}
+}
+
+// Returns a middleware for the static files served from root (with app.Static): it sets
+// Last-Modified and a weak ETag from the modification time of the file (see GetFileModTime),
+// and replies with an empty 304 without reading the file when the request already has it.
+// Only paths with an extension are handled, others (i.e. directories) go through.
+func StaticValidators(root string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+			return c.Next()
+		}
+		name := path.Clean("/" + c.Path())
+		if path.Ext(name) == "" {
+			return c.Next()
+		}
+		modTime := GetFileModTime(filepath.Join(root, filepath.FromSlash(name)))
+		if modTime.IsZero() {
+			return c.Next()
+		}
+
+		etag := fmt.Sprintf(`W/"%x"`, modTime.UnixNano())
+		if NotModified(c, etag, modTime) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+		return c.Next()
+	}
+}
@@ -1,11 +1,16 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"reflect"
-
-	"github.com/joho/godotenv"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Env is a globally-accessible variable that holds the environment variables
@@ -20,36 +25,279 @@ func init() {
 type Environment struct {
 	// Use the `env` tag to specify the name of the environment variable.
 	// Use the `default` tag to specify a default value. If a variable is not found
-	// and a default value is not specified, the application will panic.
+	// and a default value is not specified, the application will exit.
+	// Use the `validate` tag to check the value, see LoadEnv for the supported types and rules.
+	// Use the `secret:"true"` tag to redact the value when printing the configuration
+	// (names containing PASSWORD, SECRET, TOKEN or KEY are redacted anyway).
+	// Values can also come from a config file, secret files or flags, see env_layers.go.
 
 	// Application settings
-	ENVIRONMENT string `env:"ENVIRONMENT" default:"production"` // development, production, test
-	BASE_URL    string `env:"BASE_URL" default:"http://localhost:3000"`
+	ENVIRONMENT string `env:"ENVIRONMENT" default:"production" validate:"oneof=development production test"`
+	BASE_URL    string `env:"BASE_URL" default:"http://localhost:3000" validate:"url"`
 
 	// * Add more environment variables here
+
+	layers EnvLayers // Where the variables were read from.
 }
 
 func (e *Environment) init() {
-	err := godotenv.Load()
+	layers, err := DefaultEnvLayers(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Error loading configuration: %v", err)
+	}
+	e.layers = layers
+
+	err = LoadEnv(e, layers.Lookup)
 	if err != nil {
-		log.Printf("Error loading .env file: %v", err)
+		log.Fatalf("Invalid environment variables:\n%v", err)
 	}
 
-	val := reflect.ValueOf(e).Elem()
+	if slices.Contains(os.Args[1:], "--print-config") {
+		err = e.Print(os.Stdout)
+		if err != nil {
+			log.Fatalf("Error printing configuration: %v", err)
+		}
+		os.Exit(0)
+	}
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	urlType      = reflect.TypeOf(url.URL{})
+)
+
+// Fills the fields of dst (a pointer to a struct) tagged with `env`, looking up
+// the variables with lookup (i.e. os.LookupEnv). Empty variables count as missing.
+//
+// Fields can be strings, bools, ints, uints, floats, time.Duration ("90s"), url.URL or *url.URL,
+// and slices of those (comma separated values). A struct field is filled from the variables
+// prefixed with its `env` tag and an underscore, i.e. the HOST field of a struct tagged
+// `env:"SMTP"` is read from SMTP_HOST.
+//
+// The `validate` tag holds comma separated rules:
+//
+//	required            the value can't be empty (even if it's the default)
+//	oneof=a b c         the value (or each value of a slice) is one of the space separated values
+//	min=1, max=10       bounds of numbers and durations (i.e. min=1s), or of the length of strings and slices
+//	url                 the value (or each value of a slice) is an absolute URL
+//
+// Every missing or invalid variable is reported in the returned error, not only the first one.
+func LoadEnv(dst any, lookup func(name string) (string, bool)) error {
+	val := reflect.ValueOf(dst)
+	if val.Kind() != reflect.Pointer || val.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can't load environment variables into %T, it's not a pointer to a struct", dst)
+	}
+	var errs []error
+	walkEnvFields(val.Elem(), "", func(envVar string, field reflect.StructField, fieldVal reflect.Value) {
+		envValue, found := lookup(envVar)
+		if !found || envValue == "" {
+			var ok bool
+			envValue, ok = field.Tag.Lookup("default")
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: not set", envVar))
+				return
+			}
+			log.Printf("Using default value for %s: %s", envVar, envValue)
+		}
+
+		err := setEnvValue(fieldVal, envValue)
+		if err == nil {
+			err = validateEnvValue(fieldVal, field.Tag.Get("validate"))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", envVar, err))
+		}
+	})
+	return errors.Join(errs...)
+}
+
+// Calls fn for every field tagged with `env`, with the name of its variable. Struct fields are walked
+// with the prefix of their tag (see LoadEnv).
+func walkEnvFields(val reflect.Value, prefix string, fn func(envVar string, field reflect.StructField, v reflect.Value)) {
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Type().Field(i)
 		envVar, ok := field.Tag.Lookup("env")
-		if !ok {
+		if !ok || !field.IsExported() {
 			continue
 		}
-		envValue := os.Getenv(envVar)
-		if envValue == "" {
-			envValue, ok = field.Tag.Lookup("default")
-			if !ok {
-				log.Panicf("Environment variable %s not found", envVar)
+		envVar = prefix + envVar
+		fieldVal := val.Field(i)
+		if fieldVal.Kind() == reflect.Struct && fieldVal.Type() != urlType {
+			walkEnvFields(fieldVal, envVar+"_", fn)
+			continue
+		}
+		fn(envVar, field, fieldVal)
+	}
+}
+
+// Parses s into v according to its type.
+func setEnvValue(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	case v.Type() == urlType || (v.Kind() == reflect.Pointer && v.Type().Elem() == urlType):
+		u, err := parseAbsoluteURL(s)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Pointer {
+			v.Set(reflect.ValueOf(u))
+		} else {
+			v.Set(reflect.ValueOf(*u))
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, item := range strings.Split(s, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
 			}
-			log.Printf("Using default value for %s: %s", envVar, envValue)
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setEnvValue(elem, item); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		v.Set(slice)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func parseAbsoluteURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q", s)
+	}
+	return u, nil
+}
+
+// Checks v against the rules of a `validate` tag.
+func validateEnvValue(v reflect.Value, rules string) error {
+	if rules == "" {
+		return nil
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "required":
+			if v.IsZero() || (v.Kind() == reflect.Slice && v.Len() == 0) {
+				return errors.New("required")
+			}
+		case "oneof":
+			allowed := strings.Fields(arg)
+			for _, value := range envValues(v) {
+				if !slices.Contains(allowed, value) {
+					return fmt.Errorf("%q is not one of %s", value, strings.Join(allowed, ", "))
+				}
+			}
+		case "min", "max":
+			size, bound, err := envBounds(v, arg)
+			if err != nil {
+				return fmt.Errorf("invalid %s rule: %v", name, err)
+			}
+			if name == "min" && size < bound {
+				return fmt.Errorf("must be at least %s", arg)
+			}
+			if name == "max" && size > bound {
+				return fmt.Errorf("must be at most %s", arg)
+			}
+		case "url":
+			for _, value := range envValues(v) {
+				if _, err := parseAbsoluteURL(value); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unknown validation rule %q", name)
 		}
-		val.Field(i).SetString(envValue)
 	}
+	return nil
+}
+
+// Returns the value as strings, one per element for slices. Empty values are left out,
+// only the required rule rejects them.
+func envValues(v reflect.Value) []string {
+	if v.Kind() != reflect.Slice {
+		if s := envString(v); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+	values := make([]string, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		values = append(values, envString(v.Index(i)))
+	}
+	return values
+}
+
+func envString(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Type() == urlType {
+		u := v.Interface().(url.URL)
+		return u.String()
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// Returns what min and max rules compare: the value of numbers and durations,
+// or the length of strings and slices, and the bound parsed accordingly.
+func envBounds(v reflect.Value, arg string) (size, bound float64, err error) {
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(arg)
+		return float64(v.Int()), float64(d), err
+	}
+	bound, err = strconv.ParseFloat(arg, 64)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), bound, err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), bound, err
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), bound, err
+	case reflect.String, reflect.Slice:
+		return float64(v.Len()), bound, err
+	}
+	return 0, 0, fmt.Errorf("can't compare %s", v.Type())
 }
@@ -0,0 +1,354 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// This file holds the sources of the variables of Env. From the lowest to the highest precedence:
+//
+//	defaults       the `default` tags of Environment
+//	config file    --config=<path>, CONFIG_FILE, or ./config.toml, ./config.yaml or ./config.yml if present
+//	.env           the .env file in the working directory
+//	env            process environment variables, then NAME_FILE (a file holding the value) and EnvSecretsDir/NAME
+//	flags          command line flags: --base-url=http://example.com, --BASE_URL=... or --debug for "true"
+//
+// CONFIG_FILE and NAME_FILE can be set in the environment or in .env.
+//
+// Config files support a subset of TOML and YAML, enough for flat settings and one level of sections:
+// a [smtp] section (TOML) or a smtp: key with indented keys (YAML) holding host sets SMTP_HOST.
+// Keys are case insensitive, dashes and dots are read as underscores, and lists are joined with commas.
+//
+// Run the app with --print-config to print the effective configuration (secrets redacted) and exit.
+
+// Directory of the Docker/Kubernetes secret files, i.e. /run/secrets/DB_PASSWORD (or db_password).
+var EnvSecretsDir = "/run/secrets"
+
+// A source of variables, see EnvLayers.
+type EnvLayer struct {
+	Name   string // Shown by WriteEnv, i.e. "env".
+	Lookup func(name string) (string, bool)
+}
+
+// Sources of variables, the first one has the highest precedence.
+type EnvLayers []EnvLayer
+
+// Returns the value of the variable in the first layer where it's set and not empty.
+func (l EnvLayers) Lookup(name string) (string, bool) {
+	_, value, ok := l.find(name)
+	return value, ok
+}
+
+// Returns the name of the layer the variable comes from, or "default" if none has it.
+func (l EnvLayers) Source(name string) string {
+	layer, _, ok := l.find(name)
+	if !ok {
+		return "default"
+	}
+	return layer
+}
+
+func (l EnvLayers) find(name string) (string, string, bool) {
+	for _, layer := range l {
+		if value, ok := layer.Lookup(name); ok && value != "" {
+			return layer.Name, value, true
+		}
+	}
+	return "", "", false
+}
+
+// Returns the layers of Env, reading flags from args (i.e. os.Args[1:]).
+func DefaultEnvLayers(args []string) (EnvLayers, error) {
+	flags := parseEnvFlags(args)
+
+	dotEnv, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read .env: %v", err)
+	}
+
+	// Variables naming files are read before the layers exist, from the environment then .env.
+	fileVar := func(name string) string {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+		return dotEnv[name]
+	}
+
+	configFile := flags["CONFIG"]
+	if configFile == "" {
+		configFile = fileVar("CONFIG_FILE")
+	}
+	if configFile == "" {
+		for _, candidate := range []string{"config.toml", "config.yaml", "config.yml"} {
+			if _, err := os.Stat(candidate); err == nil {
+				configFile = candidate
+				break
+			}
+		}
+	}
+	config := map[string]string{}
+	if configFile != "" {
+		config, err = parseConfigFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return EnvLayers{
+		{Name: "flag", Lookup: mapLookup(flags)},
+		{Name: "env", Lookup: os.LookupEnv},
+		{Name: "secret file", Lookup: secretFileLookup(fileVar)},
+		{Name: ".env", Lookup: mapLookup(dotEnv)},
+		{Name: configFile, Lookup: mapLookup(config)},
+	}, nil
+}
+
+func mapLookup(values map[string]string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+// Returns a lookup reading the variable from the file named by NAME_FILE (read with fileVar),
+// or from the secrets directory.
+func secretFileLookup(fileVar func(name string) string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		paths := []string{filepath.Join(EnvSecretsDir, name), filepath.Join(EnvSecretsDir, strings.ToLower(name))}
+		if file := fileVar(name + "_FILE"); file != "" {
+			paths = []string{file}
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err == nil {
+				return strings.TrimRight(string(data), "\r\n"), true
+			}
+		}
+		return "", false
+	}
+}
+
+// Parses --name=value and --name (meaning "true") flags, other arguments are ignored.
+func parseEnvFlags(args []string) map[string]string {
+	flags := map[string]string{}
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !ok {
+			value = "true"
+		}
+		flags[envKey(name)] = value
+	}
+	return flags
+}
+
+// Normalizes a flag or config file key to a variable name, i.e. base-url to BASE_URL.
+func envKey(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(strings.TrimSpace(key)))
+}
+
+func parseConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	var values map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		values, err = parseTOML(string(data))
+	case ".yaml", ".yml":
+		values, err = parseYAML(string(data))
+	default:
+		return nil, fmt.Errorf("config file %s: unsupported format, use .toml, .yaml or .yml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+func parseTOML(data string) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(stripConfigComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = envKey(strings.Trim(line, "[]")) + "_"
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		parsed, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		values[section+envKey(key)] = parsed
+	}
+	return values, nil
+}
+
+func parseYAML(data string) (map[string]string, error) {
+	type parent struct {
+		indent int
+		key    string
+	}
+	values := map[string]string{}
+	var parents []parent
+	listKey := "" // Key of the list the "- item" lines belong to.
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(stripConfigComment(line), " \t\r")
+		content := strings.TrimSpace(line)
+		if content == "" || content == "---" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			if listKey == "" {
+				return nil, fmt.Errorf("line %d: list item without a key", i+1)
+			}
+			item, err := parseConfigValue(strings.TrimPrefix(content, "-"))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			values[listKey] = strings.TrimPrefix(values[listKey]+","+item, ",")
+			continue
+		}
+
+		key, value, ok := strings.Cut(content, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", i+1)
+		}
+		for len(parents) > 0 && parents[len(parents)-1].indent >= indent {
+			parents = parents[:len(parents)-1]
+		}
+		name := envKey(key)
+		if len(parents) > 0 {
+			name = parents[len(parents)-1].key + "_" + name
+		}
+		if strings.TrimSpace(value) == "" {
+			// a section, or a list
+			parents = append(parents, parent{indent, name})
+			listKey = name
+			continue
+		}
+		listKey = ""
+		parsed, err := parseConfigValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		values[name] = parsed
+	}
+	return values, nil
+}
+
+// Parses a quoted string, an inline list ([a, "b"]) joined with commas, or a bare value.
+func parseConfigValue(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		var items []string
+		for _, item := range splitConfigList(value[1 : len(value)-1]) {
+			parsed, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			if parsed != "" {
+				items = append(items, parsed)
+			}
+		}
+		return strings.Join(items, ","), nil
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", value)
+		}
+		return unquoted, nil
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
+
+// Splits the items of an inline list on the commas outside of quotes.
+func splitConfigList(list string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch c := list[i]; {
+		case quote != 0:
+			if c == quote && list[i-1] != '\\' {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, list[start:])
+}
+
+// Removes a # comment, unless the # is in quotes.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote && line[i-1] != '\\' {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// Names of the variables redacted by WriteEnv, on top of the fields tagged `secret:"true"`.
+var secretEnvName = regexp.MustCompile(`(?i)(PASSWORD|SECRET|TOKEN|KEY)`)
+
+// Writes the variables of dst (loaded with LoadEnv) with their values and sources, one per line.
+// Values of secrets are redacted.
+func WriteEnv(w io.Writer, dst any, layers EnvLayers) error {
+	val := reflect.ValueOf(dst)
+	if val.Kind() != reflect.Pointer || val.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("can't print environment variables of %T, it's not a pointer to a struct", dst)
+	}
+	var err error
+	walkEnvFields(val.Elem(), "", func(envVar string, field reflect.StructField, v reflect.Value) {
+		value := strings.Join(envValues(v), ",")
+		if value != "" && (field.Tag.Get("secret") == "true" || secretEnvName.MatchString(envVar)) {
+			value = "[redacted]"
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s=%s (%s)\n", envVar, value, layers.Source(envVar))
+		}
+	})
+	return err
+}
+
+// Writes the effective configuration of the app, see WriteEnv.
+func (e *Environment) Print(w io.Writer) error {
+	return WriteEnv(w, e, e.layers)
+}
@@ -1,11 +1,14 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/smtp"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -131,11 +134,80 @@ type MailerT struct {
 
 // Sends an email to the specified recipient(s) with the specified subject and body.
 func (m *MailerT) SendMail(to []string, subject, body string) error {
-	auth := smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	return m.SendMailContext(context.Background(), to, subject, body)
+}
+
+// Same as SendMail, but gives up as soon as the context is done,
+// so an unresponsive SMTP server can't block the caller forever.
+func (m *MailerT) SendMailContext(ctx context.Context, to []string, subject, body string) error {
 	msg := []byte("To: " + strings.Join(to, ",") + "\r\n" +
 		"Subject: " + subject + "\r\n" +
 		"\r\n" +
 		body + "\r\n")
 	addr := fmt.Sprintf("%s:%d", m.Host, m.Port)
-	return smtp.SendMail(addr, auth, m.Username, to, msg)
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Interrupt any pending read or write on the connection when the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	err = m.send(conn, to, msg)
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%v: %v", ctx.Err(), err)
+	}
+	return err
+}
+
+// Runs the SMTP conversation on an open connection, the same way smtp.SendMail does.
+func (m *MailerT) send(conn net.Conn, to []string, msg []byte) error {
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: m.Host})
+		if err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("AUTH"); ok {
+		err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = client.Mail(m.Username)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = client.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
 }
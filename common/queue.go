@@ -1,20 +1,55 @@
 package common
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/jmoiron/sqlx"
 )
 
 type QueueOptions struct {
-	Workers     int // Number of workers to process jobs. (i.e. goroutines)
-	ChannelSize int // Size of the channel to hold jobs. (i.e. buffered channel)
+	Workers        int            // Number of workers to process jobs. (i.e. goroutines)
+	ChannelSize    int            // Size of the channel to hold jobs. (i.e. buffered channel)
+	Name           string         // Name of the queue. Persisted jobs are stored under this name.
+	Db             *sqlx.DB       // If set, jobs are persisted in this SQLite database and resumed on startup. Open it with a busy timeout (i.e. "?_busy_timeout=5000") when processes share it.
+	PollInterval   time.Duration  // How often persisted jobs are loaded from the database.
+	Retry          RetryPolicy    // Default retry policy for jobs that don't have their own.
+	DeadLetterSize int            // Max number of dead jobs kept in memory by in-memory queues.
+	JobTimeout     time.Duration  // Default timeout for jobs that don't have their own. (0 means no timeout)
+	HistorySize    int            // Number of recent job runs kept for Stats.
+	RateLimits     []RateLimit    // Limits how fast jobs can be added, by job name prefix.
+	Overflow       OverflowPolicy // What AddJob does when the channel is full.
+	SpillDb        *sqlx.DB       // Where in-memory queues spill jobs with OverflowSpill.
+	Lanes          []Lane         // Lanes of the queue, see Lane. (one "default" lane if empty)
+	InstanceID     string         // Identifies this process among the ones sharing Db.
+	LeaseDuration  time.Duration  // How long a job or lock is held by a process that stopped sending heartbeats.
 }
 
 // Creates a new job queue with the given options.
 // If the number of workers is not specified, it defaults to 1.
 // If the channel size is not specified, it defaults to 100.
+// If the name is not specified, it defaults to "default".
+// If the poll interval is not specified, it defaults to 1 second.
+// If the dead letter size is not specified, it defaults to 100.
+// If the history size is not specified, it defaults to 50.
+// If the instance ID is not specified, it defaults to the hostname and the pid.
+// If the lease duration is not specified, it defaults to 30 seconds.
+// If the overflow policy is not specified, it defaults to OverflowSpill for persistent
+// queues and OverflowReject for in-memory ones.
+// If the retry policy is not specified, failed jobs are not retried.
+//
+// When a database is given the queue is persistent: jobs are stored in the
+// queue_jobs table and survive restarts. Since closures can't be stored, persistent
+// jobs must reference a handler registered with RegisterHandler.
 func NewQueue(options QueueOptions) *Queue {
 	if options.Workers == 0 {
 		options.Workers = 1
@@ -22,118 +57,989 @@ func NewQueue(options QueueOptions) *Queue {
 	if options.ChannelSize == 0 {
 		options.ChannelSize = 100
 	}
+	if options.Name == "" {
+		options.Name = "default"
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = time.Second
+	}
+	if options.DeadLetterSize == 0 {
+		options.DeadLetterSize = 100
+	}
+	if options.HistorySize == 0 {
+		options.HistorySize = 50
+	}
+	if options.InstanceID == "" {
+		options.InstanceID = defaultInstanceID()
+	}
+	if options.LeaseDuration == 0 {
+		options.LeaseDuration = 30 * time.Second
+	}
+	if options.Overflow == 0 {
+		options.Overflow = OverflowReject
+		if options.Db != nil {
+			options.Overflow = OverflowSpill
+		}
+	}
+
+	if options.Db != nil {
+		err := createQueueTables(options.Db)
+		if err != nil {
+			log.Fatalf("Error creating queue tables: %v", err)
+		}
+	}
+	if options.SpillDb != nil {
+		err := createQueueTables(options.SpillDb)
+		if err != nil {
+			log.Fatalf("Error creating queue tables: %v", err)
+		}
+	}
+
+	lanes := newLanes(options)
+	capacity := 0
+	for i, l := range lanes {
+		for _, other := range lanes[:i] {
+			if other.Name == l.Name {
+				log.Fatalf("Error creating queue %s: lane %q is defined twice", options.Name, l.Name)
+			}
+		}
+		capacity += l.Size
+	}
 
-	return &Queue{
-		IsRunning: 0,
-		Workers:   options.Workers,
-		Channel:   make(chan Job, options.ChannelSize),
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		IsRunning:    0,
+		Workers:      options.Workers,
+		Name:         options.Name,
+		Db:           options.Db,
+		Retry:        options.Retry,
+		JobTimeout:   options.JobTimeout,
+		Overflow:     options.Overflow,
+		SpillDb:      options.SpillDb,
+		InstanceID:   options.InstanceID,
+		lease:        options.LeaseDuration,
+		ctx:          ctx,
+		cancel:       cancel,
+		pollInterval: options.PollInterval,
+		handlers:     make(map[string]JobHandler),
+		queued:       make(map[int64]bool),
+		deadSize:     options.DeadLetterSize,
+		stop:         make(chan struct{}),
+		metrics:      newQueueMetrics(options.HistorySize),
+		lanes:        lanes,
+		ready:        make(chan struct{}, capacity),
+		limiter:      newRateLimiter(options.RateLimits),
 		Lock: Lock{
-			jobs: make(map[string]struct {
-				running bool
-				lastRun time.Time
-			}),
+			jobs: make(map[string]lockState),
 		},
 	}
+	if options.Db != nil {
+		q.Lock.share(options.Db, options.Name, options.InstanceID, options.LeaseDuration)
+	}
+	queuesMu.Lock()
+	queues = append(queues, q)
+	queuesMu.Unlock()
+	return q
+}
+
+// Every queue created with NewQueue, so they can all be shut down together.
+var queues []*Queue
+var queuesMu sync.Mutex
+
+// Shuts down every queue (see Queue.Shutdown) in parallel, giving them until the context
+// is done to finish their jobs. Meant to be called once when the application exits.
+func ShutdownQueues(ctx context.Context) error {
+	all := Queues()
+	errs := make(chan error, len(all))
+	for _, q := range all {
+		go func(q *Queue) {
+			errs <- q.Shutdown(ctx)
+		}(q)
+	}
+	var err error
+	for range all {
+		err = errors.Join(err, <-errs)
+	}
+	return err
 }
 
 type Queue struct {
-	IsRunning int32    // Flag to indicate if the queue is running.
-	Workers   int      // Number of workers to process jobs. (i.e. goroutines)
-	Channel   chan Job // Channel to hold jobs. (i.e. buffered channel)
-	Lock      Lock     // Job lock manager. (i.e. prevents concurrent runs if job is lockable)
+	IsRunning  int32          // Flag to indicate if the queue is running.
+	Workers    int            // Number of workers to process jobs. (i.e. goroutines)
+	Lock       Lock           // Job lock manager. (i.e. prevents concurrent runs if job is lockable)
+	Name       string         // Name of the queue.
+	Db         *sqlx.DB       // Database used to persist jobs. (nil for in-memory queues)
+	Retry      RetryPolicy    // Default retry policy for jobs that don't have their own.
+	JobTimeout time.Duration  // Default timeout for jobs that don't have their own.
+	Overflow   OverflowPolicy // What AddJob does when the channel is full.
+	SpillDb    *sqlx.DB       // Where in-memory queues spill jobs with OverflowSpill.
+	InstanceID string         // Identifies this process in the leases of persisted jobs.
+
+	pollInterval time.Duration
+	lease        time.Duration         // How long persisted jobs are leased without a heartbeat.
+	ctx          context.Context       // Parent of the jobs' contexts, cancelled when the queue is stopped.
+	cancel       context.CancelFunc    // Cancels ctx.
+	stop         chan struct{}         // Closed to stop the persisted jobs poller and the schedules.
+	stopOnce     sync.Once             // Makes sure the queue is only stopped once.
+	workers      sync.WaitGroup        // Tracks the workers, which run until the channel is drained.
+	lanes        []*lane               // Buffers of the jobs waiting for a worker, see Lane.
+	lanesMu      sync.Mutex            // Guards the lanes' round-robin credits.
+	ready        chan struct{}         // Holds a token for every job pushed to a lane, workers wait on it.
+	sendMu       sync.RWMutex          // Guards sends on ready against it being closed.
+	handlersMu   sync.RWMutex          // Guards handlers.
+	handlers     map[string]JobHandler // Named handlers for jobs that can't carry a closure.
+	queuedMu     sync.Mutex            // Guards queued.
+	queued       map[int64]bool        // IDs of persisted jobs currently sitting in a lane.
+	deadMu       sync.Mutex            // Guards dead and deadSeq.
+	dead         []DeadJob             // Dead jobs of in-memory queues, oldest first.
+	deadSeq      int64                 // Last ID given to an in-memory dead job.
+	deadSize     int                   // Max number of in-memory dead jobs.
+	metrics      *queueMetrics         // Counters, running jobs and history, see Stats.
+	limiter      *rateLimiter          // Token buckets of the rate limits.
+}
+
+// Handles a job enqueued by handler name. The payload is the job's JSON encoded payload.
+// The context is cancelled when the job times out or the queue is stopped.
+type JobHandler func(ctx context.Context, payload []byte) error
+
+// Returned (wrapped) by jobs that didn't finish within their timeout.
+var ErrJobTimeout = errors.New("job timed out")
+
+// Returned (wrapped) by jobs interrupted because the queue was stopped or the job was canceled.
+var ErrJobCanceled = errors.New("job canceled")
+
+// Returned (wrapped) by AddJob when the queue was stopped or not started yet.
+var ErrQueueNotRunning = errors.New("job queue is not running")
+
+// Returned (wrapped) by AddJob when the channel is full and the overflow policy couldn't make room.
+var ErrQueueFull = errors.New("job queue is full")
+
+// Returned (wrapped) by AddJob when a job with the same name was added within its UniqueFor window.
+var ErrJobDuplicate = errors.New("duplicate job")
+
+// Returned (wrapped) by AddJob when a rate limit of the queue is exceeded.
+var ErrJobRateLimited = errors.New("job rate limited")
+
+// Returned (wrapped) by Lock.Lock when the job is already running, in this process or another one.
+var ErrJobLocked = errors.New("job is already running")
+
+// Registers a named handler. Jobs referencing it by name are executed with it,
+// which is what allows them to be persisted and resumed after a restart.
+// Register handlers before starting the queue so resumed jobs find them.
+func (q *Queue) RegisterHandler(name string, handler JobHandler) {
+	q.handlersMu.Lock()
+	defer q.handlersMu.Unlock()
+	q.handlers[name] = handler
 }
 
 // Starts processing the jobs in the queue.
+// Persistent queues also resume the jobs left in the database by a previous run.
 func (q *Queue) StartJobQueue() {
 	atomic.StoreInt32(&q.IsRunning, 1) // Set the queue as running.
+	if q.Db != nil {
+		// Jobs still marked as running were interrupted by a restart, run them again.
+		err := q.resetRunningJobs()
+		if err != nil {
+			fmt.Printf("failed to resume jobs of queue %s: %v\n", q.Name, err)
+		}
+		err = q.Lock.resetShared()
+		if err != nil {
+			fmt.Printf("failed to release locks of queue %s: %v\n", q.Name, err)
+		}
+		go q.poll()
+		go q.heartbeat()
+	} else if q.SpillDb != nil {
+		go q.poll() // Add back jobs spilled to disk, including the ones left by the last run.
+	}
 	for i := 0; i < q.Workers; i++ {
 		// Start a goroutine for each worker.
+		q.workers.Add(1)
 		go func() {
-			// Loop indefinitely to process jobs.
-			for job := range q.Channel {
-				if atomic.LoadInt32(&q.IsRunning) == 0 {
-					return // Exit goroutine if the queue is not running.
-				}
-
-				var err error
-				// If the job is lockable, lock it to prevent concurrent runs.
-				if job.Lockable {
-					_, err = q.Lock.Lock(job.Name)
-					if err != nil { // Skip the job if it's already running.
-						fmt.Printf("failed to lock job %s: %v\n", job.Name, err)
-						continue
-					}
-					// Execute the job and unlock it when done.
-					err = job.Func()
-					q.Lock.Unlock(job.Name)
-				} else { // Execute the job if it's not lockable.
-					err = job.Func()
-				}
-				if err != nil {
-					fmt.Printf("failed to execute job %s: %v\n", job.Name, err)
+			defer q.workers.Done()
+			// Loop until the channel is closed and drained.
+			for range q.ready {
+				job, ok := q.take()
+				if ok {
+					q.process(job)
 				}
 			}
 		}()
 	}
 }
 
-// Stops processing the jobs in the queue, waits for all jobs to finish processing.
+// Processes a single job taken from the channel.
+func (q *Queue) process(job Job) {
+	if job.ID != 0 {
+		q.queuedMu.Lock()
+		delete(q.queued, job.ID)
+		q.queuedMu.Unlock()
+
+		// Claim the persisted job, skip it if it was already picked up.
+		claimed, err := q.claimJob(job.ID)
+		if err != nil {
+			fmt.Printf("failed to claim job %s: %v\n", job.Name, err)
+			return
+		}
+		if !claimed {
+			return
+		}
+	}
+
+	// The queue is being stopped, leave the job for the next start.
+	if q.ctx.Err() != nil {
+		q.release(job)
+		return
+	}
+
+	job.Attempts++
+	var err error
+	var run *activeRun
+	// If the job is lockable, lock it to prevent concurrent runs.
+	if job.Lockable {
+		_, err = q.Lock.Lock(job.Name)
+		if errors.Is(err, ErrJobLocked) { // Skip the job if it's already running.
+			fmt.Printf("failed to lock job %s: %v\n", job.Name, err)
+			q.metrics.skip(job, err)
+			q.finishJob(job)
+			return
+		}
+		if err != nil { // The lock couldn't be checked (i.e. the database is busy), try again later.
+			fmt.Printf("failed to lock job %s: %v\n", job.Name, err)
+			q.release(job)
+			return
+		}
+		// Execute the job and unlock it when done.
+		run = q.metrics.start(q.ctx, job)
+		err = q.execute(run.ctx, job)
+		q.Lock.Unlock(job.Name)
+	} else { // Execute the job if it's not lockable.
+		run = q.metrics.start(q.ctx, job)
+		err = q.execute(run.ctx, job)
+	}
+	if err == nil {
+		q.finishJob(job)
+		q.metrics.end(run, RunSucceeded, nil, false, false)
+		return
+	}
+	if errors.Is(err, ErrJobCanceled) {
+		if q.ctx.Err() != nil {
+			// The queue is being stopped, the job runs again on the next start.
+			fmt.Printf("job %s was interrupted: %v\n", job.Name, err)
+			q.release(job)
+		} else {
+			// The job was canceled on purpose, it won't run again.
+			fmt.Printf("job %s was canceled: %v\n", job.Name, err)
+			q.finishJob(job)
+		}
+		q.metrics.end(run, RunCanceled, err, false, false)
+		return
+	}
+
+	// Timeouts are retried like any other failure, they're only reported differently.
+	status := RunFailed
+	if errors.Is(err, ErrJobTimeout) {
+		fmt.Printf("job %s timed out: %v\n", job.Name, err)
+		status = RunTimedOut
+	}
+
+	// Retry the job later if it has attempts left, otherwise move it to the dead letters.
+	policy := q.retryPolicy(job)
+	retried := job.Attempts < policy.MaxAttempts
+	if retried {
+		delay := policy.delay(job.Attempts)
+		fmt.Printf("failed to execute job %s (attempt %d/%d), retrying in %s: %v\n", job.Name, job.Attempts, policy.MaxAttempts, delay, err)
+		q.retry(job, delay, err)
+	} else {
+		fmt.Printf("failed to execute job %s after %d attempt(s), moved to dead letters: %v\n", job.Name, job.Attempts, err)
+		q.bury(job, err)
+	}
+	q.metrics.end(run, status, err, retried, !retried)
+}
+
+// Runs the job with its timeout, wrapping the error with ErrJobTimeout or ErrJobCanceled
+// when the job's context was the reason it stopped.
+func (q *Queue) execute(runCtx context.Context, job Job) error {
+	ctx := runCtx
+	timeout := job.Timeout
+	if timeout == 0 {
+		timeout = q.JobTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := q.call(ctx, job)
+	if err == nil {
+		return nil
+	}
+	if runCtx.Err() != nil {
+		return fmt.Errorf("%w: %v", ErrJobCanceled, err)
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w after %s: %v", ErrJobTimeout, timeout, err)
+	}
+	return err
+}
+
+// Calls the job's function or, if it has none, its registered handler.
+func (q *Queue) call(ctx context.Context, job Job) error {
+	if job.FuncContext != nil {
+		return job.FuncContext(ctx)
+	}
+	if job.Func != nil {
+		return job.Func()
+	}
+	q.handlersMu.RLock()
+	handler, ok := q.handlers[job.Handler]
+	q.handlersMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler registered for %s", job.Handler)
+	}
+	payload, err := json.Marshal(job.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+	return handler(ctx, payload)
+}
+
+// Gives back a job that didn't get to run because the queue is being stopped.
+// Persisted jobs go back to pending and run on the next start, in-memory jobs are lost.
+func (q *Queue) release(job Job) {
+	if job.ID == 0 {
+		fmt.Printf("dropping job %s: queue %s was stopped\n", job.Name, q.Name)
+		return
+	}
+	err := q.releaseJob(job.ID)
+	if err != nil {
+		fmt.Printf("failed to release job %s: %v\n", job.Name, err)
+	}
+}
+
+// Removes a persisted job that is done. In-memory jobs have nothing to remove.
+func (q *Queue) finishJob(job Job) {
+	if job.ID == 0 {
+		return
+	}
+	err := q.deleteJob(job.ID)
+	if err != nil {
+		fmt.Printf("failed to delete job %s: %v\n", job.Name, err)
+	}
+}
+
+// Schedules a failed job to run again after the delay.
+func (q *Queue) retry(job Job, delay time.Duration, jobErr error) {
+	if job.ID != 0 {
+		err := q.retryJob(job.ID, delay, jobErr)
+		if err != nil {
+			fmt.Printf("failed to retry job %s: %v\n", job.Name, err)
+		}
+		return
+	}
+	time.AfterFunc(delay, func() {
+		if !q.push(job) {
+			q.bury(job, fmt.Errorf("failed to requeue job, queue is full or stopped (last error: %v)", jobErr))
+		}
+	})
+}
+
+// Moves a job that ran out of attempts to the dead letters.
+func (q *Queue) bury(job Job, jobErr error) {
+	if job.ID != 0 {
+		err := q.buryJob(job.ID, jobErr)
+		if err != nil {
+			fmt.Printf("failed to move job %s to dead letters: %v\n", job.Name, err)
+		}
+		return
+	}
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+	q.deadSeq++
+	q.dead = append(q.dead, DeadJob{
+		ID:        q.deadSeq,
+		Job:       job,
+		LastError: jobErr.Error(),
+		FailedAt:  time.Now(),
+	})
+	if len(q.dead) > q.deadSize {
+		q.dead = q.dead[len(q.dead)-q.deadSize:] // Forget the oldest dead jobs.
+	}
+}
+
+// Returns the retry policy of the job, falling back to the queue's one.
+func (q *Queue) retryPolicy(job Job) RetryPolicy {
+	if job.Retry != nil {
+		return job.Retry.withDefaults()
+	}
+	return q.Retry.withDefaults()
+}
+
+// Returns the jobs that ran out of attempts, oldest first.
+func (q *Queue) DeadJobs() ([]DeadJob, error) {
+	if q.Db != nil {
+		return q.deadJobs()
+	}
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+	dead := make([]DeadJob, len(q.dead))
+	copy(dead, q.dead)
+	return dead, nil
+}
+
+// Puts a dead job back in the queue with its attempts reset.
+func (q *Queue) RequeueDeadJob(id int64) error {
+	if atomic.LoadInt32(&q.IsRunning) == 0 {
+		return fmt.Errorf("job queue is not running")
+	}
+	if q.Db != nil {
+		job, err := q.requeueDeadJob(id)
+		if err != nil {
+			return err
+		}
+		q.push(job)
+		return nil
+	}
+	dead, ok := q.takeDeadJob(id)
+	if !ok {
+		return fmt.Errorf("dead job %d not found", id)
+	}
+	dead.Job.Attempts = 0
+	if !q.push(dead.Job) {
+		q.bury(dead.Job, fmt.Errorf("failed to requeue job, queue is full"))
+		return fmt.Errorf("job queue is full")
+	}
+	return nil
+}
+
+// Deletes a dead job for good.
+func (q *Queue) DeleteDeadJob(id int64) error {
+	if q.Db != nil {
+		return q.deleteDeadJob(id)
+	}
+	_, ok := q.takeDeadJob(id)
+	if !ok {
+		return fmt.Errorf("dead job %d not found", id)
+	}
+	return nil
+}
+
+// Removes an in-memory dead job and returns it.
+func (q *Queue) takeDeadJob(id int64) (DeadJob, bool) {
+	q.deadMu.Lock()
+	defer q.deadMu.Unlock()
+	for i, dead := range q.dead {
+		if dead.ID == id {
+			q.dead = append(q.dead[:i], q.dead[i+1:]...)
+			return dead, true
+		}
+	}
+	return DeadJob{}, false
+}
+
+// Stops processing the jobs in the queue right away: the context of the running jobs is
+// cancelled and the jobs left in the channel are not run. Waits for the running jobs to return.
+// Persistent queues run the jobs left behind on the next start, in-memory queues lose them.
+// Use Shutdown to let the jobs finish instead.
 func (q *Queue) StopJobQueue() {
-	atomic.StoreInt32(&q.IsRunning, 0) // Set the queue as not running to prevent new jobs.
-	close(q.Channel)                   // Close the job queue channel.
-	for len(q.Channel) > 0 {
-		time.Sleep(100 * time.Millisecond) // Wait for jobs to finish processing.
+	q.cancel()
+	q.Shutdown(context.Background())
+}
+
+// How long Shutdown waits for the workers once it gave up on the jobs, so they can
+// record what happened to them (i.e. release persisted jobs) before the databases are closed.
+var QueueShutdownGracePeriod = 5 * time.Second
+
+// Stops accepting new jobs and waits for the workers to process the jobs already
+// in the channel, including the ones running right now. When the context is done it
+// gives up: the context of the running jobs is cancelled, the jobs left are not run
+// (see StopJobQueue) and an error is returned once the workers exit, or after QueueShutdownGracePeriod.
+// Workers still running after that (i.e. jobs with a Func ignoring their context) are abandoned:
+// their database writes may fail, and persisted jobs run again once their lease expires.
+// Delayed jobs and retries that aren't due yet are lost in in-memory queues.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.stopOnce.Do(func() {
+		atomic.StoreInt32(&q.IsRunning, 0) // Set the queue as not running to prevent new jobs.
+		close(q.stop)                      // Stop loading persisted jobs and scheduling new ones.
+		q.sendMu.Lock()
+		close(q.ready) // Workers exit once the lanes are drained.
+		q.sendMu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait() // Wait for jobs to finish processing.
+		close(done)
+	}()
+	select {
+	case <-done:
+		q.cancel()
+		return nil
+	case <-ctx.Done():
+		left := q.queuedLen()
+		q.cancel()
+		select {
+		case <-done:
+		case <-time.After(QueueShutdownGracePeriod):
+			fmt.Printf("abandoning the running jobs of queue %s\n", q.Name)
+		}
+		return fmt.Errorf("queue %s didn't finish its jobs (%d left in the channel): %v", q.Name, left, ctx.Err())
 	}
 }
 
-// Attempts to add a job to the queue. Fails if the queue is not running or if the queue is full.
+// Attempts to add a job to the queue. Fails with ErrQueueNotRunning if the queue is not running.
+// When the channel is full the queue's overflow policy applies (see OverflowPolicy), the
+// default ones fail with ErrQueueFull for in-memory queues and never fail for persistent ones.
 func (q *Queue) AddJob(job Job) error {
+	return q.addJob(context.Background(), job, time.Time{}, q.Overflow)
+}
+
+// Adds a job to the queue, waiting for room in the channel until the context is done
+// whatever the overflow policy. Fails with ErrQueueFull if there's still no room by then.
+// Use it to slow callers down (i.e. backpressure) instead of failing right away.
+func (q *Queue) AddJobContext(ctx context.Context, job Job) error {
+	return q.addJob(ctx, job, time.Time{}, OverflowBlock)
+}
+
+// Adds a job to be run at the given time (or soon after, when a worker is free).
+// In-memory queues keep the job in a timer and add it when it's due, so it fails
+// then (and is logged) if the queue is full or stopped. Persistent queues store it right away.
+func (q *Queue) AddJobAt(job Job, at time.Time) error {
+	return q.addJob(context.Background(), job, at, q.Overflow)
+}
+
+// Adds a job to be run after the given delay. See AddJobAt.
+func (q *Queue) AddJobIn(job Job, delay time.Duration) error {
+	return q.addJob(context.Background(), job, time.Now().Add(delay), q.Overflow)
+}
+
+// Adds a job to the queue, to be run as soon as possible if runAt is zero or in the past.
+// The overflow policy applies if the channel is full when the job is due.
+func (q *Queue) addJob(ctx context.Context, job Job, runAt time.Time, overflow OverflowPolicy) error {
 	if atomic.LoadInt32(&q.IsRunning) == 0 { // Check if the queue is running.
-		return fmt.Errorf("job queue is not running")
+		return fmt.Errorf("%w: can't add job %s to queue %s", ErrQueueNotRunning, job.Name, q.Name)
 	}
-	select {
-	case q.Channel <- job: // Add the job to the queue if there's space.
+	if job.Func == nil && job.FuncContext == nil && job.Handler == "" {
+		return fmt.Errorf("job %s has neither a function nor a handler", job.Name)
+	}
+	if q.Db != nil && (job.Func != nil || job.FuncContext != nil) {
+		return fmt.Errorf("job %s can't be persisted because it uses a function, register a handler instead", job.Name)
+	}
+	l, err := q.lane(job.Lane)
+	if err != nil {
+		return err
+	}
+	job.Lane = l.Name
+
+	// Reserve the job's uniqueness window and a token of its rate limits,
+	// both are given back if the job can't be added after all.
+	var undo []func()
+	if job.UniqueFor > 0 {
+		release, err := q.Lock.reserve(job.Name, job.UniqueFor)
+		if err != nil {
+			return err
+		}
+		undo = append(undo, release)
+	}
+	refund, err := q.limiter.take(job.Name)
+	if err != nil {
+		for _, f := range undo {
+			f()
+		}
+		return err
+	}
+	undo = append(undo, refund)
+	err = q.enqueue(ctx, job, runAt, overflow)
+	if err != nil {
+		for _, f := range undo {
+			f()
+		}
+	}
+	return err
+}
+
+// Stores and/or pushes a validated job.
+func (q *Queue) enqueue(ctx context.Context, job Job, runAt time.Time, overflow OverflowPolicy) error {
+	if q.Db != nil {
+		id, err := q.insertJob(job, runAt)
+		if err != nil {
+			return fmt.Errorf("failed to persist job %s: %v", job.Name, err)
+		}
+		job.ID = id
+		// If the job isn't due yet it stays in the database and gets picked up later.
+		if !time.Now().Before(runAt) {
+			err = q.send(ctx, job, overflow)
+			if err != nil && q.deletePendingJob(id) == nil {
+				return err
+			}
+			// If the job can't be deleted a worker got it in the meantime, so it was added after all.
+		}
+		q.metrics.enqueue()
 		return nil
-	default: // Fails if the queue is full.
-		return fmt.Errorf("job queue is full")
+	}
+	if time.Now().Before(runAt) {
+		q.metrics.enqueue()
+		time.AfterFunc(time.Until(runAt), func() {
+			err := q.send(context.Background(), job, overflow)
+			if err != nil {
+				fmt.Printf("failed to add delayed job %s: %v\n", job.Name, err)
+			}
+		})
+		return nil
+	}
+	err := q.send(ctx, job, overflow)
+	if err != nil {
+		return err
+	}
+	q.metrics.enqueue()
+	return nil
+}
+
+// Pushes a job into the channel without blocking. Returns false if it couldn't.
+func (q *Queue) push(job Job) bool {
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if atomic.LoadInt32(&q.IsRunning) == 0 {
+		return false
+	}
+	if job.ID != 0 {
+		q.queuedMu.Lock()
+		defer q.queuedMu.Unlock()
+		if q.queued[job.ID] {
+			return true // Already waiting in the channel.
+		}
+	}
+	select {
+	case q.laneOf(job).ch <- job: // Add the job to its lane if there's space.
+		q.ready <- struct{}{}
+		if job.ID != 0 {
+			q.queued[job.ID] = true
+		}
+		return true
+	default: // Fails if the lane is full.
+		return false
+	}
+}
+
+// Runs the job on a cron schedule (see CronSchedule for the syntax) until the queue is stopped.
+// Scheduled jobs are always lockable so a run never overlaps the previous one: if the
+// previous run is still going when the job is due, that run is skipped.
+// Processes sharing a persistent queue all run the schedule, but each run is only added
+// by the first one to reserve it in the shared lock table.
+func (q *Queue) Schedule(spec string, job Job) error {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	job.Lockable = true
+
+	go func() {
+		for {
+			next := schedule.Next(time.Now())
+			if next.IsZero() {
+				fmt.Printf("scheduled job %s will never run again\n", job.Name)
+				return
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-q.stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if q.Lock.IsLocked(job.Name) {
+				fmt.Printf("skipping scheduled job %s: previous run is still running\n", job.Name)
+				continue
+			}
+			if q.Db != nil {
+				// The reservation of the run lasts until the next one.
+				until := schedule.Next(next)
+				if until.IsZero() {
+					until = next.Add(24 * time.Hour)
+				}
+				reserved, err := q.Lock.reserveShared(fmt.Sprintf("%s@%d", job.Name, next.Unix()), until)
+				if err != nil {
+					fmt.Printf("failed to reserve scheduled job %s: %v\n", job.Name, err)
+					continue
+				}
+				if !reserved {
+					continue // Another process added this run.
+				}
+			}
+			err := q.AddJob(job)
+			if err != nil {
+				fmt.Printf("failed to add scheduled job %s: %v\n", job.Name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Periodically moves pending persisted jobs (or spilled jobs for in-memory queues)
+// into the channel until the queue is stopped.
+func (q *Queue) poll() {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	for {
+		for i, l := range q.lanes {
+			free := cap(l.ch) - len(l.ch)
+			if free == 0 {
+				continue
+			}
+			if q.Db == nil {
+				q.unspill(l, i == 0, free)
+				continue
+			}
+			jobs, err := q.pendingJobs(l.Name, i == 0, free)
+			if err != nil {
+				fmt.Printf("failed to load jobs of queue %s: %v\n", q.Name, err)
+			}
+			for _, job := range jobs {
+				if !q.push(job) {
+					break
+				}
+			}
+		}
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 // Describes a job type with a name, function and lockable flag.
+// A job runs either one of its functions or, when it has none, the handler registered
+// under its handler name with its payload. Only handler jobs can be persisted.
+//
+// Prefer FuncContext over Func: its context is cancelled when the job times out or
+// the queue is stopped, while a Func can't be interrupted and ignores the timeout.
 type Job struct {
-	Name     string       // Unique name for the job (you can use params into the name if needed).
-	Func     func() error // Function to execute the job.
-	Lockable bool         // If true the job (exact same name) can't be run concurrently.
+	ID          int64                           // ID of the persisted job. (0 for in-memory jobs)
+	Name        string                          // Unique name for the job (you can use params into the name if needed).
+	Func        func() error                    // Function to execute the job.
+	FuncContext func(ctx context.Context) error // Function to execute the job, with a context.
+	Lockable    bool                            // If true the job (exact same name) can't be run concurrently.
+	UniqueFor   time.Duration                   // If set, other jobs with the same name are rejected for this long.
+	Lane        string                          // Lane of the job. (empty for the queue's first lane)
+	Handler     string                          // Name of the registered handler to execute the job with.
+	Payload     interface{}                     // Payload passed to the handler, it's JSON encoded.
+	Retry       *RetryPolicy                    // Retry policy of the job. (nil to use the queue's one)
+	Timeout     time.Duration                   // Timeout of the job. (0 to use the queue's one)
+	RunAt       time.Time                       // When the persisted job is due. (set by the queue)
+	Attempts    int                             // Number of times the job was attempted. (set by the queue)
+}
+
+// Describes how failed jobs are retried. The delay before a retry doubles after
+// every attempt: Backoff, 2*Backoff, 4*Backoff... up to MaxBackoff.
+type RetryPolicy struct {
+	MaxAttempts int           // Max number of attempts, including the first one. Defaults to 1. (i.e. no retries)
+	Backoff     time.Duration // Delay before the first retry. Defaults to 1 second.
+	MaxBackoff  time.Duration // Upper bound of the delay between attempts. Defaults to 1 hour.
+	Jitter      float64       // Fraction of the delay (0-1) randomly added or removed to spread retries out.
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = time.Second
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = time.Hour
+	}
+	return p
+}
+
+// Returns the delay before the next attempt, given the number of attempts already made.
+func (p RetryPolicy) delay(attempts int) time.Duration {
+	delay := float64(p.Backoff) * math.Pow(2, float64(attempts-1))
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(delay)
+}
+
+// Describes a job that failed on every attempt.
+type DeadJob struct {
+	ID        int64     // ID of the dead job. (the job's ID for persistent queues)
+	Job       Job       // The job itself, Job.Attempts tells how many times it ran.
+	LastError string    // Error returned by the last attempt.
+	FailedAt  time.Time // When the last attempt failed.
 }
 
 // Manages job execution states to prevent concurrent runs.
+// The lock of a persistent queue is shared with the other processes using its database.
 type Lock struct {
-	mu   sync.Mutex
-	jobs map[string]struct {
-		running bool
-		lastRun time.Time
-	}
+	mu     sync.Mutex
+	jobs   map[string]lockState
+	pruned time.Time // Last time the expired uniqueness windows were forgotten.
+
+	db    *sqlx.DB      // Database holding the shared locks. (nil for in-memory queues)
+	queue string        // Name of the queue the shared locks belong to.
+	owner string        // Instance ID of this process.
+	lease time.Duration // How long a shared lock is held without a heartbeat.
 }
 
-// Attempts to lock a job for execution.
+type lockState struct {
+	running     bool
+	lastRun     time.Time // When the job was last added (unique jobs) or started.
+	uniqueUntil time.Time // Other jobs with the same name are rejected until then.
+}
+
+// Attempts to lock a job for execution. Fails with ErrJobLocked if the job is already running,
+// or with another error if the shared lock couldn't be checked.
 func (l *Lock) Lock(jobName string) (bool, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	job, ok := l.jobs[jobName]
 	if ok && job.running {
-		return false, fmt.Errorf("job %s is already running", jobName)
+		return false, fmt.Errorf("%w: job %s", ErrJobLocked, jobName)
+	}
+	if l.db != nil {
+		claimed, err := l.claimShared(jobName)
+		if err != nil {
+			return false, fmt.Errorf("failed to lock job %s: %v", jobName, err)
+		}
+		if !claimed {
+			return false, fmt.Errorf("%w: job %s in another process", ErrJobLocked, jobName)
+		}
 	}
 	// Update the job's state whether it's new or existing.
-	l.jobs[jobName] = struct {
-		running bool
-		lastRun time.Time
-	}{running: true, lastRun: time.Now()}
+	job.running = true
+	job.lastRun = time.Now()
+	l.jobs[jobName] = job
 	return true, nil
 }
 
-// Releases the lock on a job.
+// Reserves a uniqueness window for a job that is about to be added. Fails with
+// ErrJobDuplicate if the job is running or its last window isn't over yet.
+// The returned function gives the reservation back.
+func (l *Lock) reserve(jobName string, window time.Duration) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	prev, ok := l.jobs[jobName]
+	if ok && prev.running {
+		return nil, fmt.Errorf("%w: job %s is already running", ErrJobDuplicate, jobName)
+	}
+	if ok && now.Before(prev.uniqueUntil) {
+		return nil, fmt.Errorf("%w: job %s was already added %s ago", ErrJobDuplicate, jobName, now.Sub(prev.lastRun).Round(time.Second))
+	}
+	until := now.Add(window)
+	if l.db != nil {
+		reserved, err := l.reserveShared(jobName, until)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reserve job %s: %v", jobName, err)
+		}
+		if !reserved {
+			return nil, fmt.Errorf("%w: job %s is running or was added less than %s ago in another process", ErrJobDuplicate, jobName, window)
+		}
+	}
+	job := prev
+	job.lastRun = now
+	job.uniqueUntil = until
+	l.jobs[jobName] = job
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.db != nil {
+			err := l.unreserveShared(jobName, until)
+			if err != nil {
+				fmt.Printf("failed to release reservation of job %s: %v\n", jobName, err)
+			}
+		}
+		job, ok := l.jobs[jobName]
+		if !ok || !job.uniqueUntil.Equal(until) {
+			return // Reserved again since.
+		}
+		job.lastRun = prev.lastRun
+		job.uniqueUntil = prev.uniqueUntil
+		l.jobs[jobName] = job
+	}, nil
+}
+
+// Forgets jobs that aren't running and whose uniqueness window is over, at most once a minute.
+func (l *Lock) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for name, job := range l.jobs {
+		if !job.running && !now.Before(job.uniqueUntil) {
+			delete(l.jobs, name)
+		}
+	}
+}
+
+// Returns the names of the jobs currently locked (by any process), sorted.
+func (l *Lock) Locked() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	locked := make(map[string]bool)
+	for name, job := range l.jobs {
+		if job.running {
+			locked[name] = true
+		}
+	}
+	if l.db != nil {
+		shared, err := l.lockedShared()
+		if err != nil {
+			fmt.Printf("failed to list locks of queue %s: %v\n", l.queue, err)
+		}
+		for _, name := range shared {
+			locked[name] = true
+		}
+	}
+	var names []string
+	for name := range locked {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Tells whether a job is currently locked (i.e. running) by any process.
+func (l *Lock) IsLocked(jobName string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.jobs[jobName].running {
+		return true
+	}
+	if l.db != nil {
+		locked, err := l.isLockedShared(jobName)
+		if err != nil {
+			fmt.Printf("failed to check lock of job %s: %v\n", jobName, err)
+		}
+		return locked
+	}
+	return false
+}
+
+// Releases the lock on a job. Its last run is remembered until its uniqueness window is over.
 func (l *Lock) Unlock(jobName string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	if l.db != nil {
+		err := l.releaseShared(jobName)
+		if err != nil {
+			fmt.Printf("failed to unlock job %s: %v\n", jobName, err)
+		}
+	}
+	job, ok := l.jobs[jobName]
+	if !ok {
+		return
+	}
+	if time.Now().Before(job.uniqueUntil) {
+		job.running = false
+		l.jobs[jobName] = job
+		return
+	}
 	delete(l.jobs, jobName)
 }
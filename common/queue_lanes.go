@@ -0,0 +1,104 @@
+package common
+
+import "fmt"
+
+// A lane of a queue. Every lane has its own buffer and workers take jobs from the lanes
+// with a smooth weighted round-robin: with weights 10 and 1, the first lane gets 10 jobs
+// for every job of the second one when both have jobs waiting, and all of them when the
+// second one is empty. Low weight lanes are slowed down but never starved.
+type Lane struct {
+	Name   string // Name of the lane, referenced by Job.Lane.
+	Weight int    // Share of the workers' attention, defaults to 1.
+	Size   int    // Size of the lane's buffer, defaults to QueueOptions.ChannelSize.
+}
+
+type lane struct {
+	Lane
+	ch      chan Job
+	current int // Credit of the smooth weighted round-robin.
+}
+
+// Creates the lanes of a queue, or a single "default" lane if none are configured.
+func newLanes(options QueueOptions) []*lane {
+	configs := options.Lanes
+	if len(configs) == 0 {
+		configs = []Lane{{Name: "default"}}
+	}
+	lanes := make([]*lane, len(configs))
+	for i, config := range configs {
+		if config.Weight <= 0 {
+			config.Weight = 1
+		}
+		if config.Size <= 0 {
+			config.Size = options.ChannelSize
+		}
+		lanes[i] = &lane{Lane: config, ch: make(chan Job, config.Size)}
+	}
+	return lanes
+}
+
+// Returns the lane with the given name. Jobs without a lane go in the first one.
+func (q *Queue) lane(name string) (*lane, error) {
+	if name == "" {
+		return q.lanes[0], nil
+	}
+	for _, l := range q.lanes {
+		if l.Name == name {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("queue %s has no lane %q", q.Name, name)
+}
+
+// Returns the lane of a job that is already in the queue, falling back to the first
+// lane if its lane was removed since. (i.e. persisted jobs)
+func (q *Queue) laneOf(job Job) *lane {
+	l, err := q.lane(job.Lane)
+	if err != nil {
+		return q.lanes[0]
+	}
+	return l
+}
+
+// Takes the next job from the lanes, see Lane. Returns false if they're all empty.
+func (q *Queue) take() (Job, bool) {
+	q.lanesMu.Lock()
+	defer q.lanesMu.Unlock()
+	tried := make(map[*lane]bool, len(q.lanes))
+	for {
+		var candidates []*lane
+		var best *lane
+		for _, l := range q.lanes {
+			if tried[l] || len(l.ch) == 0 {
+				continue
+			}
+			candidates = append(candidates, l)
+			if best == nil || l.current+l.Weight > best.current+best.Weight {
+				best = l
+			}
+		}
+		if best == nil {
+			return Job{}, false
+		}
+		select {
+		case job := <-best.ch:
+			// Every lane with jobs earns its weight, the picked one pays for all of them.
+			for _, l := range candidates {
+				l.current += l.Weight
+				best.current -= l.Weight
+			}
+			return job, true
+		default:
+			tried[best] = true // Emptied by another worker in the meantime.
+		}
+	}
+}
+
+// Returns the number of jobs waiting in the lanes.
+func (q *Queue) queuedLen() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += len(l.ch)
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// This file lets several processes (i.e. app containers sharing a db volume) use the
+// same persistent queue. Jobs are leased by the process that claims them (see claimJob)
+// and locks of lockable jobs and uniqueness windows live in the queue_locks table, so
+// a job locked in a process is locked in all of them. Every process renews its leases
+// with a heartbeat, when it dies its leases expire and its jobs are run again elsewhere.
+
+// Returns an ID for this process, made of the hostname and the pid. It's unique among the
+// processes sharing a database and stays the same when a container restarts (pid 1),
+// which lets it pick up its own interrupted jobs right away.
+func defaultInstanceID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Renews the leases of the jobs and locks held by this process and reclaims the ones of
+// dead processes, until the queue's context is cancelled. (i.e. its jobs are done)
+func (q *Queue) heartbeat() {
+	ticker := time.NewTicker(q.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := q.extendJobLeases()
+		if err != nil {
+			fmt.Printf("failed to extend job leases of queue %s: %v\n", q.Name, err)
+		}
+		err = q.Lock.extendLeases()
+		if err != nil {
+			fmt.Printf("failed to extend lock leases of queue %s: %v\n", q.Name, err)
+		}
+		n, err := q.reclaimExpiredJobs()
+		if err != nil {
+			fmt.Printf("failed to reclaim jobs of queue %s: %v\n", q.Name, err)
+		} else if n > 0 {
+			fmt.Printf("reclaimed %d job(s) of queue %s with an expired lease\n", n, q.Name)
+		}
+		err = q.Lock.pruneShared()
+		if err != nil {
+			fmt.Printf("failed to prune locks of queue %s: %v\n", q.Name, err)
+		}
+	}
+}
+
+// Makes the lock shared by every process using the database.
+func (l *Lock) share(db *sqlx.DB, queue, owner string, lease time.Duration) {
+	l.db = db
+	l.queue = queue
+	l.owner = owner
+	l.lease = lease
+}
+
+// Takes the shared lock of a job. Returns false if another process holds it.
+func (l *Lock) claimShared(jobName string) (bool, error) {
+	now := time.Now()
+	res, err := l.db.Exec(`
+		INSERT INTO queue_locks (queue, name, claimed_by, lease_expires_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (queue, name) DO UPDATE SET claimed_by = excluded.claimed_by, lease_expires_at = excluded.lease_expires_at
+		WHERE queue_locks.lease_expires_at < ?`,
+		l.queue, jobName, l.owner, now.Add(l.lease).UnixMilli(), now.UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Releases the shared lock of a job, its uniqueness window (if any) stays.
+func (l *Lock) releaseShared(jobName string) error {
+	_, err := l.db.Exec(`
+		UPDATE queue_locks SET claimed_by = '', lease_expires_at = 0
+		WHERE queue = ? AND name = ? AND claimed_by = ?`, l.queue, jobName, l.owner)
+	return err
+}
+
+// Tells whether a process holds the shared lock of a job.
+func (l *Lock) isLockedShared(jobName string) (bool, error) {
+	var count int
+	err := l.db.Get(&count, `
+		SELECT COUNT(*) FROM queue_locks WHERE queue = ? AND name = ? AND lease_expires_at >= ?`,
+		l.queue, jobName, time.Now().UnixMilli())
+	return count > 0, err
+}
+
+// Returns the names of the jobs locked by any process.
+func (l *Lock) lockedShared() ([]string, error) {
+	var names []string
+	err := l.db.Select(&names, `
+		SELECT name FROM queue_locks WHERE queue = ? AND lease_expires_at >= ? ORDER BY name`,
+		l.queue, time.Now().UnixMilli())
+	return names, err
+}
+
+// Starts the shared uniqueness window of a job. Returns false if the job is locked
+// or its last window isn't over yet.
+func (l *Lock) reserveShared(jobName string, until time.Time) (bool, error) {
+	now := time.Now().UnixMilli()
+	res, err := l.db.Exec(`
+		INSERT INTO queue_locks (queue, name, unique_until) VALUES (?, ?, ?)
+		ON CONFLICT (queue, name) DO UPDATE SET unique_until = excluded.unique_until
+		WHERE queue_locks.unique_until <= ? AND queue_locks.lease_expires_at < ?`,
+		l.queue, jobName, until.UnixMilli(), now, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Gives back a shared uniqueness window, unless it was reserved again since.
+func (l *Lock) unreserveShared(jobName string, until time.Time) error {
+	_, err := l.db.Exec(`
+		UPDATE queue_locks SET unique_until = 0
+		WHERE queue = ? AND name = ? AND unique_until = ?`, l.queue, jobName, until.UnixMilli())
+	return err
+}
+
+// Extends the leases of the locks held by this process.
+func (l *Lock) extendLeases() error {
+	_, err := l.db.Exec(`
+		UPDATE queue_locks SET lease_expires_at = ?
+		WHERE queue = ? AND claimed_by = ? AND lease_expires_at > 0`,
+		time.Now().Add(l.lease).UnixMilli(), l.queue, l.owner)
+	return err
+}
+
+// Releases the locks left by the previous run of this process.
+func (l *Lock) resetShared() error {
+	_, err := l.db.Exec(`
+		UPDATE queue_locks SET claimed_by = '', lease_expires_at = 0
+		WHERE queue = ? AND claimed_by = ?`, l.queue, l.owner)
+	return err
+}
+
+// Forgets the locks that expired and whose uniqueness window is over.
+func (l *Lock) pruneShared() error {
+	now := time.Now().UnixMilli()
+	_, err := l.db.Exec(`
+		DELETE FROM queue_locks WHERE queue = ? AND lease_expires_at < ? AND unique_until < ?`,
+		l.queue, now, now)
+	return err
+}
@@ -0,0 +1,87 @@
+package common
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits how fast jobs whose name starts with Prefix can be added to a queue. It's a token
+// bucket: it holds up to Burst tokens, refilled at Limit tokens per Per, and every job
+// added takes one. Jobs added while the bucket is empty are rejected with ErrJobRateLimited.
+// The bucket is shared by every job matching the prefix, use Job.UniqueFor to limit a
+// single job name (i.e. one email address).
+type RateLimit struct {
+	Prefix string        // Job name prefix the limit applies to. ("" matches every job)
+	Limit  int           // Jobs allowed per period.
+	Per    time.Duration // Period of the limit, defaults to 1 second.
+	Burst  int           // Jobs that can be added at once, defaults to Limit.
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	rate   float64 // Tokens added per second.
+	tokens float64
+	last   time.Time // Last time tokens were added.
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets []*tokenBucket
+}
+
+func newRateLimiter(limits []RateLimit) *rateLimiter {
+	r := &rateLimiter{}
+	for _, limit := range limits {
+		if limit.Limit <= 0 {
+			continue
+		}
+		if limit.Per == 0 {
+			limit.Per = time.Second
+		}
+		if limit.Burst == 0 {
+			limit.Burst = limit.Limit
+		}
+		r.buckets = append(r.buckets, &tokenBucket{
+			limit:  limit,
+			rate:   float64(limit.Limit) / limit.Per.Seconds(),
+			tokens: float64(limit.Burst),
+			last:   time.Now(),
+		})
+	}
+	return r
+}
+
+// Takes a token from every bucket matching the job name, or none if one of them is empty.
+// The returned function puts the tokens back.
+func (r *rateLimiter) take(jobName string) (func(), error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	var matching []*tokenBucket
+	for _, b := range r.buckets {
+		if !strings.HasPrefix(jobName, b.limit.Prefix) {
+			continue
+		}
+		b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		if b.tokens < 1 {
+			wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+			return nil, fmt.Errorf("%w: %d jobs per %s allowed for %q, try again in %s",
+				ErrJobRateLimited, b.limit.Limit, b.limit.Per, b.limit.Prefix, (wait + time.Second - 1).Truncate(time.Second))
+		}
+		matching = append(matching, b)
+	}
+	for _, b := range matching {
+		b.tokens--
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, b := range matching {
+			b.tokens = math.Min(float64(b.limit.Burst), b.tokens+1)
+		}
+	}, nil
+}
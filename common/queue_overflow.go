@@ -0,0 +1,156 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Tells a queue what to do with a job when its channel is full.
+type OverflowPolicy int
+
+const (
+	// Fails with ErrQueueFull.
+	OverflowReject OverflowPolicy = iota + 1
+	// Waits for room in the channel, until the queue is stopped. (or the context of AddJobContext is done)
+	OverflowBlock
+	// Drops the oldest job waiting in the channel to make room. Persisted jobs dropped this way are deleted.
+	OverflowDropOldest
+	// Writes the job to disk and adds it back once there's room. Persistent queues keep it
+	// in their database, in-memory queues need a SpillDb and can only spill handler jobs.
+	OverflowSpill
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowReject:
+		return "reject"
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop oldest"
+	case OverflowSpill:
+		return "spill"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(p))
+}
+
+// Pushes a job into the channel, applying the overflow policy if it's full.
+func (q *Queue) send(ctx context.Context, job Job, policy OverflowPolicy) error {
+	if q.push(job) {
+		return nil
+	}
+	if atomic.LoadInt32(&q.IsRunning) == 0 {
+		return fmt.Errorf("%w: can't add job %s to queue %s", ErrQueueNotRunning, job.Name, q.Name)
+	}
+	switch policy {
+	case OverflowBlock:
+		return q.pushContext(ctx, job)
+	case OverflowDropOldest:
+		q.dropOldest(q.laneOf(job))
+		if q.push(job) {
+			return nil
+		}
+	case OverflowSpill:
+		if job.ID != 0 {
+			return nil // Already in the database, it's loaded once there's room.
+		}
+		if q.SpillDb != nil && job.Func == nil && job.FuncContext == nil {
+			err := q.spillJob(job)
+			if err != nil {
+				return fmt.Errorf("failed to spill job %s: %v", job.Name, err)
+			}
+			q.metrics.spill()
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: can't add job %s to lane %s of queue %s (%d jobs waiting)", ErrQueueFull, job.Name, q.laneOf(job).Name, q.Name, len(q.laneOf(job).ch))
+}
+
+// Pushes a job into the channel, waiting for room until the context is done or the queue is stopped.
+func (q *Queue) pushContext(ctx context.Context, job Job) error {
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if atomic.LoadInt32(&q.IsRunning) == 0 {
+		return fmt.Errorf("%w: can't add job %s to queue %s", ErrQueueNotRunning, job.Name, q.Name)
+	}
+	if job.ID != 0 {
+		// Mark the job as queued while waiting so the poller doesn't push it as well.
+		q.queuedMu.Lock()
+		if q.queued[job.ID] {
+			q.queuedMu.Unlock()
+			return nil
+		}
+		q.queued[job.ID] = true
+		q.queuedMu.Unlock()
+	}
+	select {
+	case q.laneOf(job).ch <- job:
+		q.ready <- struct{}{}
+		return nil
+	case <-ctx.Done():
+		q.unqueue(job)
+		return fmt.Errorf("%w: gave up adding job %s to queue %s: %v", ErrQueueFull, job.Name, q.Name, ctx.Err())
+	case <-q.stop: // Shutdown closes stop before it waits for sendMu to close the channel.
+		q.unqueue(job)
+		return fmt.Errorf("%w: queue %s was stopped while adding job %s", ErrQueueNotRunning, q.Name, job.Name)
+	}
+}
+
+// Drops the oldest job waiting in the lane, if any.
+func (q *Queue) dropOldest(l *lane) {
+	q.sendMu.RLock()
+	defer q.sendMu.RUnlock()
+	if atomic.LoadInt32(&q.IsRunning) == 0 {
+		return // The channel may be closed, leave it to the workers.
+	}
+	select {
+	case old := <-l.ch:
+		// Take its token as well. If a worker got it first, it just won't find a job.
+		select {
+		case <-q.ready:
+		default:
+		}
+		fmt.Printf("dropping job %s: queue %s is full\n", old.Name, q.Name)
+		q.metrics.drop()
+		if old.ID != 0 {
+			q.unqueue(old)
+			err := q.deletePendingJob(old.ID)
+			if err != nil {
+				fmt.Printf("failed to delete dropped job %s: %v\n", old.Name, err)
+			}
+		}
+	default:
+	}
+}
+
+// Forgets that a persisted job sits in the channel.
+func (q *Queue) unqueue(job Job) {
+	if job.ID == 0 {
+		return
+	}
+	q.queuedMu.Lock()
+	delete(q.queued, job.ID)
+	q.queuedMu.Unlock()
+}
+
+// Moves up to limit spilled jobs of the lane back into memory, oldest first.
+// The first lane also gets the jobs whose lane doesn't exist anymore.
+func (q *Queue) unspill(l *lane, first bool, limit int) {
+	jobs, err := q.spilledJobs(l.Name, first, limit)
+	if err != nil {
+		fmt.Printf("failed to load spilled jobs of queue %s: %v\n", q.Name, err)
+		return
+	}
+	for _, job := range jobs {
+		id := job.ID
+		job.ID = 0 // Back in memory, the row is only a copy.
+		if !q.push(job) {
+			return
+		}
+		err = q.deleteSpilledJob(id)
+		if err != nil {
+			fmt.Printf("failed to delete spilled job %s: %v\n", job.Name, err)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// This file holds the SQLite side of persistent queues (see QueueOptions.Db).
+// Every queue sharing a database stores its jobs in the same queue_jobs table,
+// kept apart by the queue column. A job row goes through these statuses:
+//
+//	pending -> running -> (deleted when done), pending (to be retried) or dead
+//
+// Several processes can share a queue: a running row is leased by the process that
+// claimed it (claimed_by) until lease_expires_at, and the lease is extended by a
+// heartbeat while the job runs. Rows whose lease expired (i.e. the process crashed)
+// are set back to pending by any process, and by the same process on startup.
+// Dead rows are the dead letters of the queue, they stay until requeued or deleted.
+// In-memory queues can spill jobs to the table when they're full (see OverflowSpill),
+// those rows are spilled until they're loaded back into memory and deleted.
+// Times used for scheduling (run_at) are stored as unix milliseconds.
+
+func createQueueTables(db *sqlx.DB) error {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS queue_jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue TEXT NOT NULL,
+		name TEXT NOT NULL,
+		handler TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		lockable BOOLEAN NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		run_at INTEGER NOT NULL DEFAULT 0,
+		retry TEXT NOT NULL DEFAULT '',
+		timeout_ms INTEGER NOT NULL DEFAULT 0,
+		lane TEXT NOT NULL DEFAULT '',
+		claimed_by TEXT NOT NULL DEFAULT '',
+		lease_expires_at INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS idx_queue_jobs_queue_status ON queue_jobs (queue, status)`)
+	if err != nil {
+		return err
+	}
+
+	// locks and uniqueness windows of jobs, shared by the processes using the database (see Lock)
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS queue_locks (
+		queue TEXT NOT NULL,
+		name TEXT NOT NULL,
+		claimed_by TEXT NOT NULL DEFAULT '',
+		lease_expires_at INTEGER NOT NULL DEFAULT 0,
+		unique_until INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (queue, name)
+	)`)
+	return err
+}
+
+const queueJobColumns = `id, name, handler, payload, lockable, attempts, retry, timeout_ms, run_at, lane, last_error, updated_at`
+
+type queueJobRow struct {
+	ID        int64     `db:"id"`
+	Name      string    `db:"name"`
+	Handler   string    `db:"handler"`
+	Payload   string    `db:"payload"`
+	Lockable  bool      `db:"lockable"`
+	Attempts  int       `db:"attempts"`
+	Retry     string    `db:"retry"`
+	TimeoutMs int64     `db:"timeout_ms"`
+	RunAt     int64     `db:"run_at"`
+	Lane      string    `db:"lane"`
+	LastError string    `db:"last_error"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+func (r queueJobRow) job() Job {
+	job := Job{
+		ID:       r.ID,
+		Name:     r.Name,
+		Handler:  r.Handler,
+		Payload:  json.RawMessage(r.Payload),
+		Lockable: r.Lockable,
+		Attempts: r.Attempts,
+		Timeout:  time.Duration(r.TimeoutMs) * time.Millisecond,
+		Lane:     r.Lane,
+	}
+	if r.RunAt > 0 {
+		job.RunAt = time.UnixMilli(r.RunAt)
+	}
+	if r.Retry != "" {
+		var retry RetryPolicy
+		if json.Unmarshal([]byte(r.Retry), &retry) == nil {
+			job.Retry = &retry
+		}
+	}
+	return job
+}
+
+// Stores a new pending job, due at runAt (or right away if it's zero), and returns its ID.
+func (q *Queue) insertJob(job Job, runAt time.Time) (int64, error) {
+	payload, err := json.Marshal(job.Payload)
+	if err != nil {
+		return 0, err
+	}
+	var retry []byte
+	if job.Retry != nil {
+		retry, err = json.Marshal(job.Retry)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var runAtMilli int64
+	if !runAt.IsZero() {
+		runAtMilli = runAt.UnixMilli()
+	}
+	res, err := q.Db.Exec(`
+		INSERT INTO queue_jobs (queue, name, handler, payload, lockable, retry, timeout_ms, run_at, lane)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		q.Name, job.Name, job.Handler, string(payload), job.Lockable, string(retry), job.Timeout.Milliseconds(), runAtMilli, job.Lane)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// Returns the condition matching the jobs of a lane. The first lane also gets the jobs
+// whose lane doesn't exist anymore (or that were stored before lanes existed).
+func (q *Queue) laneCondition(name string, first bool) (string, []interface{}) {
+	if !first {
+		return `lane = ?`, []interface{}{name}
+	}
+	if len(q.lanes) == 1 {
+		return `1 = 1`, nil
+	}
+	others := q.lanes[1:]
+	args := make([]interface{}, len(others))
+	for i, l := range others {
+		args[i] = l.Name
+	}
+	return `lane NOT IN (?` + strings.Repeat(`, ?`, len(others)-1) + `)`, args
+}
+
+// Returns up to limit pending jobs of a lane that are due, oldest first.
+func (q *Queue) pendingJobs(lane string, first bool, limit int) ([]Job, error) {
+	cond, args := q.laneCondition(lane, first)
+	var rows []queueJobRow
+	err := q.Db.Select(&rows, `
+		SELECT `+queueJobColumns+` FROM queue_jobs
+		WHERE queue = ? AND status = 'pending' AND run_at <= ? AND `+cond+`
+		ORDER BY run_at, id LIMIT ?`, append(append([]interface{}{q.Name, time.Now().UnixMilli()}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, len(rows))
+	for i, row := range rows {
+		jobs[i] = row.job()
+	}
+	return jobs, nil
+}
+
+// Counts the pending jobs, including the ones that aren't due yet.
+func (q *Queue) countPendingJobs() (int, error) {
+	var count int
+	err := q.Db.Get(&count, `SELECT COUNT(*) FROM queue_jobs WHERE queue = ? AND status = 'pending'`, q.Name)
+	return count, err
+}
+
+// Returns up to limit pending jobs, including the ones that aren't due yet, the next due first.
+func (q *Queue) listPendingJobs(limit int) ([]Job, error) {
+	var rows []queueJobRow
+	err := q.Db.Select(&rows, `
+		SELECT `+queueJobColumns+` FROM queue_jobs
+		WHERE queue = ? AND status = 'pending'
+		ORDER BY run_at, id LIMIT ?`, q.Name, limit)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, len(rows))
+	for i, row := range rows {
+		jobs[i] = row.job()
+	}
+	return jobs, nil
+}
+
+// Deletes a pending job.
+func (q *Queue) deletePendingJob(id int64) error {
+	res, err := q.Db.Exec(`DELETE FROM queue_jobs WHERE id = ? AND queue = ? AND status = 'pending'`, id, q.Name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("pending job %d not found", id)
+	}
+	return nil
+}
+
+// Writes an in-memory job to the spill database.
+func (q *Queue) spillJob(job Job) error {
+	payload, err := json.Marshal(job.Payload)
+	if err != nil {
+		return err
+	}
+	var retry []byte
+	if job.Retry != nil {
+		retry, err = json.Marshal(job.Retry)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = q.SpillDb.Exec(`
+		INSERT INTO queue_jobs (queue, name, handler, payload, lockable, retry, timeout_ms, attempts, lane, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, 'spilled')`,
+		q.Name, job.Name, job.Handler, string(payload), job.Lockable, string(retry), job.Timeout.Milliseconds(), job.Attempts, job.Lane)
+	return err
+}
+
+// Returns up to limit spilled jobs of a lane, oldest first.
+func (q *Queue) spilledJobs(lane string, first bool, limit int) ([]Job, error) {
+	cond, args := q.laneCondition(lane, first)
+	var rows []queueJobRow
+	err := q.SpillDb.Select(&rows, `
+		SELECT `+queueJobColumns+` FROM queue_jobs
+		WHERE queue = ? AND status = 'spilled' AND `+cond+`
+		ORDER BY id LIMIT ?`, append(append([]interface{}{q.Name}, args...), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]Job, len(rows))
+	for i, row := range rows {
+		jobs[i] = row.job()
+	}
+	return jobs, nil
+}
+
+// Deletes a spilled job that is back in memory.
+func (q *Queue) deleteSpilledJob(id int64) error {
+	_, err := q.SpillDb.Exec(`DELETE FROM queue_jobs WHERE id = ? AND status = 'spilled'`, id)
+	return err
+}
+
+// Marks a pending job as running, leased by this process. Returns false if the job is no longer pending.
+func (q *Queue) claimJob(id int64) (bool, error) {
+	res, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'running', attempts = attempts + 1, claimed_by = ?, lease_expires_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'pending'`, q.InstanceID, time.Now().Add(q.lease).UnixMilli(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Deletes a job that is done. Does nothing if the job's lease was lost, it runs again elsewhere.
+func (q *Queue) deleteJob(id int64) error {
+	_, err := q.Db.Exec(`DELETE FROM queue_jobs WHERE id = ? AND claimed_by = ?`, id, q.InstanceID)
+	return err
+}
+
+// Sets a failed job back to pending, to be run again after the delay.
+func (q *Queue) retryJob(id int64, delay time.Duration, jobErr error) error {
+	_, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'pending', run_at = ?, last_error = ?, claimed_by = '', lease_expires_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND claimed_by = ?`, time.Now().Add(delay).UnixMilli(), jobErr.Error(), id, q.InstanceID)
+	return err
+}
+
+// Marks a job that ran out of attempts as dead.
+func (q *Queue) buryJob(id int64, jobErr error) error {
+	_, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'dead', last_error = ?, claimed_by = '', lease_expires_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND claimed_by = ?`, jobErr.Error(), id, q.InstanceID)
+	return err
+}
+
+// Returns the dead jobs of the queue, oldest first.
+func (q *Queue) deadJobs() ([]DeadJob, error) {
+	var rows []queueJobRow
+	err := q.Db.Select(&rows, `
+		SELECT `+queueJobColumns+` FROM queue_jobs
+		WHERE queue = ? AND status = 'dead'
+		ORDER BY updated_at, id`, q.Name)
+	if err != nil {
+		return nil, err
+	}
+	dead := make([]DeadJob, len(rows))
+	for i, row := range rows {
+		dead[i] = DeadJob{
+			ID:        row.ID,
+			Job:       row.job(),
+			LastError: row.LastError,
+			FailedAt:  row.UpdatedAt,
+		}
+	}
+	return dead, nil
+}
+
+// Sets a dead job back to pending with its attempts reset and returns it.
+func (q *Queue) requeueDeadJob(id int64) (Job, error) {
+	res, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'pending', attempts = 0, run_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND queue = ? AND status = 'dead'`, id, q.Name)
+	if err != nil {
+		return Job{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Job{}, err
+	}
+	if n == 0 {
+		return Job{}, fmt.Errorf("dead job %d not found", id)
+	}
+
+	var row queueJobRow
+	err = q.Db.Get(&row, `SELECT `+queueJobColumns+` FROM queue_jobs WHERE id = ?`, id)
+	if err != nil {
+		return Job{}, err
+	}
+	return row.job(), nil
+}
+
+// Deletes a dead job.
+func (q *Queue) deleteDeadJob(id int64) error {
+	res, err := q.Db.Exec(`DELETE FROM queue_jobs WHERE id = ? AND queue = ? AND status = 'dead'`, id, q.Name)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("dead job %d not found", id)
+	}
+	return nil
+}
+
+// Sets a job that didn't get to run back to pending, without counting the attempt.
+func (q *Queue) releaseJob(id int64) error {
+	_, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'pending', attempts = MAX(attempts - 1, 0), claimed_by = '', lease_expires_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND status = 'running' AND claimed_by = ?`, id, q.InstanceID)
+	return err
+}
+
+// Sets jobs interrupted while running back to pending: the ones left by the previous
+// run of this process and the ones whose lease expired.
+func (q *Queue) resetRunningJobs() error {
+	_, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'pending', claimed_by = '', lease_expires_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE queue = ? AND status = 'running' AND (claimed_by IN (?, '') OR lease_expires_at < ?)`,
+		q.Name, q.InstanceID, time.Now().UnixMilli())
+	return err
+}
+
+// Sets jobs whose lease expired back to pending, their process died while running them.
+func (q *Queue) reclaimExpiredJobs() (int64, error) {
+	res, err := q.Db.Exec(`
+		UPDATE queue_jobs SET status = 'pending', claimed_by = '', lease_expires_at = 0, updated_at = CURRENT_TIMESTAMP
+		WHERE queue = ? AND status = 'running' AND lease_expires_at < ? AND claimed_by NOT IN (?, '')`,
+		q.Name, time.Now().UnixMilli(), q.InstanceID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Extends the leases of the jobs this process is running.
+func (q *Queue) extendJobLeases() error {
+	_, err := q.Db.Exec(`
+		UPDATE queue_jobs SET lease_expires_at = ?
+		WHERE queue = ? AND status = 'running' AND claimed_by = ?`,
+		time.Now().Add(q.lease).UnixMilli(), q.Name, q.InstanceID)
+	return err
+}
@@ -0,0 +1,345 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file keeps track of what a queue is doing: counters, a latency histogram,
+// the jobs running right now and a bounded history of the last runs.
+// Everything is in memory and starts from zero on every start, see Queue.Stats.
+
+// Statuses of a job run.
+const (
+	RunRunning   = "running"   // The job is running right now.
+	RunSucceeded = "succeeded" // The job returned no error.
+	RunFailed    = "failed"    // The job returned an error.
+	RunTimedOut  = "timed out" // The job didn't finish within its timeout.
+	RunCanceled  = "canceled"  // The job was canceled or the queue was stopped.
+	RunSkipped   = "skipped"   // The job is lockable and was already running.
+)
+
+// Upper bounds of the latency histogram buckets. A last bucket catches the slower runs.
+var latencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// Describes a single run (i.e. attempt) of a job.
+type JobRun struct {
+	ID        int64         // ID of the run, used to cancel it while it's running.
+	JobID     int64         // ID of the persisted job. (0 for in-memory jobs)
+	Name      string        // Name of the job.
+	Attempt   int           // Which attempt of the job this run is.
+	Status    string        // One of the Run* statuses.
+	Error     string        // Error returned by the job, if any.
+	Retried   bool          // Whether the job was scheduled to run again after failing.
+	Dead      bool          // Whether the job was moved to the dead letters after failing.
+	StartedAt time.Time     // When the run started.
+	Duration  time.Duration // How long the run took. (so far, if it's still running)
+}
+
+// Describes a lane of a queue, see Lane.
+type LaneStats struct {
+	Name   string
+	Weight int
+	Size   int
+	Queued int // Jobs waiting in the lane.
+}
+
+// Counts the runs that took up to UpTo. The last bucket has no bound (UpTo is 0).
+type LatencyBucket struct {
+	UpTo  time.Duration
+	Count uint64
+}
+
+// A snapshot of what a queue is doing, see Queue.Stats.
+type QueueStats struct {
+	Name        string
+	Persistent  bool
+	InstanceID  string // Identifies this process in the leases of persisted jobs.
+	IsRunning   bool
+	Workers     int
+	BusyWorkers int // Workers running a job right now.
+	Queued      int // Jobs waiting in the lanes.
+	Pending     int // Jobs waiting in the database, including delayed jobs and retries. (persistent queues only)
+
+	Enqueued  uint64 // Jobs added to the queue.
+	Succeeded uint64 // Runs that returned no error.
+	Failed    uint64 // Runs that returned an error. (timeouts excluded)
+	TimedOut  uint64 // Runs that timed out.
+	Canceled  uint64 // Runs that were canceled.
+	Skipped   uint64 // Runs skipped because the (lockable) job was already running.
+	Retried   uint64 // Failed runs scheduled to run again.
+	Dead      uint64 // Failed runs moved to the dead letters.
+	Dropped   uint64 // Jobs dropped because the channel was full. (see OverflowDropOldest)
+	Spilled   uint64 // Jobs spilled to disk because the channel was full. (see OverflowSpill)
+
+	Lanes         []LaneStats     // Jobs waiting by lane.
+	TotalDuration time.Duration   // Time spent running jobs.
+	Latency       []LatencyBucket // Histogram of the run durations.
+	LockedJobs    []string        // Names of the lockable jobs running right now.
+	RunningJobs   []JobRun        // Runs in progress, oldest first.
+	History       []JobRun        // Last runs, most recent first.
+}
+
+// Returns the fraction (0-1) of workers busy running a job.
+func (s QueueStats) Utilization() float64 {
+	if s.Workers == 0 {
+		return 0
+	}
+	return float64(s.BusyWorkers) / float64(s.Workers)
+}
+
+// Returns the average duration of the finished runs.
+func (s QueueStats) AverageDuration() time.Duration {
+	runs := s.Succeeded + s.Failed + s.TimedOut + s.Canceled
+	if runs == 0 {
+		return 0
+	}
+	return s.TotalDuration / time.Duration(runs)
+}
+
+type queueMetrics struct {
+	mu            sync.Mutex
+	runSeq        int64
+	enqueued      uint64
+	counts        map[string]uint64 // Finished runs by status.
+	retried       uint64
+	dead          uint64
+	dropped       uint64
+	spilled       uint64
+	totalDuration time.Duration
+	latency       []uint64
+	running       map[int64]*activeRun
+	history       []JobRun // Ring buffer of the last runs.
+	historyNext   int      // Where the next run goes in history.
+	historySize   int
+}
+
+type activeRun struct {
+	JobRun
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newQueueMetrics(historySize int) *queueMetrics {
+	return &queueMetrics{
+		counts:      make(map[string]uint64),
+		latency:     make([]uint64, len(latencyBuckets)+1),
+		running:     make(map[int64]*activeRun),
+		historySize: historySize,
+	}
+}
+
+func (m *queueMetrics) enqueue() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enqueued++
+}
+
+func (m *queueMetrics) drop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dropped++
+}
+
+func (m *queueMetrics) spill() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spilled++
+}
+
+// Registers a new run of the job. Its context is a child of ctx and can be canceled with Queue.CancelRunningJob.
+func (m *queueMetrics) start(ctx context.Context, job Job) *activeRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runSeq++
+	run := &activeRun{
+		JobRun: JobRun{
+			ID:        m.runSeq,
+			JobID:     job.ID,
+			Name:      job.Name,
+			Attempt:   job.Attempts,
+			Status:    RunRunning,
+			StartedAt: time.Now(),
+		},
+	}
+	run.ctx, run.cancel = context.WithCancel(ctx)
+	m.running[run.ID] = run
+	return run
+}
+
+// Records the outcome of a run, and whether the job was scheduled to run again or moved to the dead letters.
+func (m *queueMetrics) end(run *activeRun, status string, err error, retried, dead bool) {
+	run.cancel()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.running, run.ID)
+	run.Status = status
+	run.Duration = time.Since(run.StartedAt)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.Retried, run.Dead = retried, dead
+	if run.Retried {
+		m.retried++
+	}
+	if run.Dead {
+		m.dead++
+	}
+	m.counts[status]++
+	m.totalDuration += run.Duration
+	m.latency[sort.Search(len(latencyBuckets), func(i int) bool { return run.Duration <= latencyBuckets[i] })]++
+	m.remember(run.JobRun)
+}
+
+// Records a job that was skipped without running.
+func (m *queueMetrics) skip(job Job, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.runSeq++
+	m.counts[RunSkipped]++
+	m.remember(JobRun{
+		ID:        m.runSeq,
+		JobID:     job.ID,
+		Name:      job.Name,
+		Attempt:   job.Attempts,
+		Status:    RunSkipped,
+		Error:     err.Error(),
+		StartedAt: time.Now(),
+	})
+}
+
+// Adds a finished run to the history, overwriting the oldest one when it's full.
+func (m *queueMetrics) remember(run JobRun) {
+	if m.historySize <= 0 {
+		return
+	}
+	if len(m.history) < m.historySize {
+		m.history = append(m.history, run)
+	} else {
+		m.history[m.historyNext] = run
+	}
+	m.historyNext = (m.historyNext + 1) % m.historySize
+}
+
+// Returns a snapshot of the queue's metrics. Persistent queues also count
+// the jobs waiting in the database.
+func (q *Queue) Stats() (QueueStats, error) {
+	m := q.metrics
+	m.mu.Lock()
+	stats := QueueStats{
+		Name:          q.Name,
+		Persistent:    q.Db != nil,
+		InstanceID:    q.InstanceID,
+		IsRunning:     atomic.LoadInt32(&q.IsRunning) == 1,
+		Workers:       q.Workers,
+		BusyWorkers:   len(m.running),
+		Queued:        q.queuedLen(),
+		Enqueued:      m.enqueued,
+		Succeeded:     m.counts[RunSucceeded],
+		Failed:        m.counts[RunFailed],
+		TimedOut:      m.counts[RunTimedOut],
+		Canceled:      m.counts[RunCanceled],
+		Skipped:       m.counts[RunSkipped],
+		Retried:       m.retried,
+		Dead:          m.dead,
+		Dropped:       m.dropped,
+		Spilled:       m.spilled,
+		TotalDuration: m.totalDuration,
+	}
+	for i, count := range m.latency {
+		bucket := LatencyBucket{Count: count}
+		if i < len(latencyBuckets) {
+			bucket.UpTo = latencyBuckets[i]
+		}
+		stats.Latency = append(stats.Latency, bucket)
+	}
+	for _, run := range m.running {
+		r := run.JobRun
+		r.Duration = time.Since(r.StartedAt)
+		stats.RunningJobs = append(stats.RunningJobs, r)
+	}
+	for i := range m.history {
+		// Walk the ring buffer backwards, from the most recent run.
+		stats.History = append(stats.History, m.history[(m.historyNext-1-i+2*len(m.history))%len(m.history)])
+	}
+	m.mu.Unlock()
+
+	for _, l := range q.lanes {
+		stats.Lanes = append(stats.Lanes, LaneStats{Name: l.Name, Weight: l.Weight, Size: l.Size, Queued: len(l.ch)})
+	}
+	sort.Slice(stats.RunningJobs, func(i, j int) bool { return stats.RunningJobs[i].ID < stats.RunningJobs[j].ID })
+	stats.LockedJobs = q.Lock.Locked()
+
+	if q.Db != nil {
+		pending, err := q.countPendingJobs()
+		if err != nil {
+			return stats, err
+		}
+		stats.Pending = pending
+	}
+	return stats, nil
+}
+
+// Cancels the context of a running job. The job is not retried.
+func (q *Queue) CancelRunningJob(runID int64) error {
+	q.metrics.mu.Lock()
+	run, ok := q.metrics.running[runID]
+	q.metrics.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("run %d is not running", runID)
+	}
+	run.cancel()
+	return nil
+}
+
+// Returns up to limit jobs waiting in the database (including delayed jobs and retries),
+// the next ones due first. In-memory queues can't list the jobs in their channel and return none.
+func (q *Queue) PendingJobs(limit int) ([]Job, error) {
+	if q.Db == nil {
+		return nil, nil
+	}
+	return q.listPendingJobs(limit)
+}
+
+// Removes a job waiting in the database so it never runs.
+func (q *Queue) DeletePendingJob(id int64) error {
+	if q.Db == nil {
+		return fmt.Errorf("queue %s is not persistent", q.Name)
+	}
+	return q.deletePendingJob(id)
+}
+
+// Returns every queue created with NewQueue, in creation order.
+func Queues() []*Queue {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	all := make([]*Queue, len(queues))
+	copy(all, queues)
+	return all
+}
+
+// Returns the queue with the given name, or nil if there's none.
+func GetQueue(name string) *Queue {
+	for _, q := range Queues() {
+		if q.Name == name {
+			return q
+		}
+	}
+	return nil
+}
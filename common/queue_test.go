@@ -0,0 +1,247 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Waits until cond returns true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func queueStats(t *testing.T, q *Queue) QueueStats {
+	t.Helper()
+	stats, err := q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+// Stats is read by /admin/jobs while jobs fail, run with -race.
+func TestQueueStatsWhileJobsFail(t *testing.T) {
+	q := NewQueue(QueueOptions{Name: "test-stats-race", Workers: 4})
+	q.StartJobQueue()
+	defer q.StopJobQueue()
+
+	// Read the stats as often as possible while the jobs run.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				q.Stats()
+			}
+		}
+	}()
+
+	const jobs = 50 // Retries need room in the channel too, it holds 100 jobs.
+	for i := 0; i < jobs; i++ {
+		err := q.AddJob(Job{
+			Name:  fmt.Sprintf("failing-%d", i),
+			Func:  func() error { return errors.New("boom") },
+			Retry: &RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "the jobs to be dead", func() bool {
+		return queueStats(t, q).Dead == jobs
+	})
+	stats := queueStats(t, q)
+	if stats.Retried != jobs || stats.Failed != 2*jobs {
+		t.Fatalf("got %d retried and %d failed runs, want %d and %d", stats.Retried, stats.Failed, jobs, 2*jobs)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if queueStats(t, q).IsRunning {
+		t.Fatal("the queue is still running after Shutdown")
+	}
+}
+
+// Opens a database shared by the queues of a test, like several processes would.
+func openQueueDb(t *testing.T, name string) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("sqlite3", "./db/"+name+".db?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Every process sharing a queue runs its schedules, each run must still be added once.
+func TestQueueScheduleSharedAcrossProcesses(t *testing.T) {
+	db := openQueueDb(t, "test-schedule")
+	// Start right after a second so the ticks counted don't depend on when the test runs.
+	start := time.Now().Truncate(time.Second).Add(time.Second + 100*time.Millisecond)
+	time.Sleep(time.Until(start))
+	var runs atomic.Int32
+	for _, instance := range []string{"a", "b"} {
+		q := NewQueue(QueueOptions{Name: "test-schedule", Db: db, InstanceID: instance, PollInterval: 20 * time.Millisecond})
+		q.RegisterHandler("tick", func(ctx context.Context, payload []byte) error {
+			runs.Add(1)
+			return nil
+		})
+		q.StartJobQueue()
+		defer q.StopJobQueue()
+		if err := q.Schedule("@every 1s", Job{Name: "tick", Handler: "tick"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const ticks = 2
+	time.Sleep(time.Until(start.Add(ticks * time.Second)))
+	waitFor(t, "the runs", func() bool { return runs.Load() >= ticks })
+	time.Sleep(100 * time.Millisecond) // Leave time for duplicates to run.
+	if got := runs.Load(); got != ticks {
+		t.Fatalf("got %d runs for %d ticks", got, ticks)
+	}
+}
+
+// A job failing on every attempt goes to the dead letters, and runs again once requeued.
+func TestQueueDeadLetters(t *testing.T) {
+	q := NewQueue(QueueOptions{Name: "test-dead", Db: openQueueDb(t, "test-dead"), PollInterval: 10 * time.Millisecond})
+	var healthy atomic.Bool
+	var runs atomic.Int32
+	q.RegisterHandler("flaky", func(ctx context.Context, payload []byte) error {
+		runs.Add(1)
+		if !healthy.Load() {
+			return errors.New("boom")
+		}
+		return nil
+	})
+	q.StartJobQueue()
+	defer q.StopJobQueue()
+
+	err := q.AddJob(Job{Name: "flaky", Handler: "flaky", Retry: &RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dead []DeadJob
+	waitFor(t, "the dead job", func() bool {
+		dead, err = q.DeadJobs()
+		return err == nil && len(dead) == 1
+	})
+	if dead[0].Job.Attempts != 3 || dead[0].LastError != "boom" || runs.Load() != 3 {
+		t.Fatalf("got a dead job with %d attempts and error %q after %d runs, want 3 attempts and boom",
+			dead[0].Job.Attempts, dead[0].LastError, runs.Load())
+	}
+
+	healthy.Store(true)
+	if err := q.RequeueDeadJob(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the requeued job", func() bool { return queueStats(t, q).Succeeded == 1 })
+	dead, err = q.DeadJobs()
+	if err != nil || len(dead) != 0 {
+		t.Fatalf("got %d dead jobs (%v), want none", len(dead), err)
+	}
+}
+
+// Jobs with UniqueFor reject the same job until the window is over.
+func TestQueueUniqueFor(t *testing.T) {
+	q := NewQueue(QueueOptions{Name: "test-unique"})
+	q.StartJobQueue()
+	defer q.StopJobQueue()
+	job := func(name string) Job {
+		return Job{Name: name, Func: func() error { return nil }, UniqueFor: 50 * time.Millisecond}
+	}
+
+	if err := q.AddJob(job("digest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.AddJob(job("digest")); !errors.Is(err, ErrJobDuplicate) {
+		t.Fatalf("got %v, want ErrJobDuplicate", err)
+	}
+	if err := q.AddJob(job("digest-2")); err != nil {
+		t.Fatalf("another job was rejected: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := q.AddJob(job("digest")); err != nil {
+		t.Fatalf("the job was rejected after its window: %v", err)
+	}
+}
+
+// Shutdown runs the jobs already added before returning, then rejects new ones.
+func TestQueueShutdownDrains(t *testing.T) {
+	q := NewQueue(QueueOptions{Name: "test-drain", Workers: 2})
+	q.StartJobQueue()
+	var runs atomic.Int32
+	const jobs = 20
+	for i := 0; i < jobs; i++ {
+		err := q.AddJob(Job{Name: fmt.Sprintf("slow-%d", i), Func: func() error {
+			time.Sleep(5 * time.Millisecond)
+			runs.Add(1)
+			return nil
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := runs.Load(); got != jobs {
+		t.Fatalf("got %d runs, want %d", got, jobs)
+	}
+	err := q.AddJob(Job{Name: "late", Func: func() error { return nil }})
+	if !errors.Is(err, ErrQueueNotRunning) {
+		t.Fatalf("got %v, want ErrQueueNotRunning", err)
+	}
+}
+
+// A job claimed by a process that died runs again elsewhere once its lease expires, not before.
+func TestQueueLeaseExpiry(t *testing.T) {
+	db := openQueueDb(t, "test-lease")
+	const lease = 200 * time.Millisecond
+	crashed := NewQueue(QueueOptions{Name: "test-lease", Db: db, InstanceID: "crashed", LeaseDuration: lease})
+	id, err := crashed.insertJob(Job{Name: "report", Handler: "report"}, time.Time{})
+	if err == nil {
+		_, err = crashed.claimJob(id)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed := time.Now()
+
+	var ran atomic.Int64
+	q := NewQueue(QueueOptions{Name: "test-lease", Db: db, InstanceID: "alive", LeaseDuration: 60 * time.Millisecond, PollInterval: 10 * time.Millisecond})
+	q.RegisterHandler("report", func(ctx context.Context, payload []byte) error {
+		ran.Store(time.Now().UnixNano())
+		return nil
+	})
+	q.StartJobQueue()
+	defer q.StopJobQueue()
+
+	waitFor(t, "the job to run again", func() bool { return ran.Load() != 0 })
+	if after := time.Unix(0, ran.Load()).Sub(claimed); after < lease {
+		t.Fatalf("the job ran again %s after it was claimed, before its lease expired", after)
+	}
+}
@@ -0,0 +1,422 @@
+package common
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// This file holds the runtime settings of the app: values an admin can change from
+// /admin/settings without restarting it, stored in the sqlite3 database (like the mailer configuration).
+//
+// Modules declare their settings in package variables, with a type and a default:
+//
+//	var SignupOpen = common.NewSetting("auth.signup_open", common.SettingOptions[bool]{
+//		Label:   "Signups open",
+//		Default: true,
+//	})
+//
+// and read them with SignupOpen.Get() wherever they're needed, so changes apply on the next request.
+// Code that caches something derived from a setting can Subscribe to be told when it changes.
+// Once StartSettingsReload is called, settings are reloaded from the database periodically, so
+// changes made by another instance of the app (or directly in the database) are picked up too.
+
+var SettingsDb *sqlx.DB
+
+func init() {
+	var err error
+	SettingsDb, err = sqlx.Open("sqlite3", "./db/settings.db")
+	if err != nil {
+		log.Fatalf("Error opening database: %v", err)
+	}
+
+	// optimize the database
+	optimizationStmts := `
+    PRAGMA journal_mode = WAL;
+    PRAGMA synchronous = NORMAL;
+    PRAGMA cache_size = -64000;  -- 64MB
+    PRAGMA temp_store = MEMORY;`
+	_, err = SettingsDb.Exec(optimizationStmts)
+	if err != nil {
+		log.Fatalf("Error optimizing database: %v", err)
+	}
+
+	_, err = SettingsDb.Exec(`
+	CREATE TABLE IF NOT EXISTS settings (
+		key TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		value TEXT NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		log.Fatalf("Error creating settings table: %v", err)
+	}
+
+	// Settings declared in this package (i.e. SiteName) are registered before the database is open.
+	err = ReloadSettings()
+	if err != nil {
+		log.Fatalf("Error loading settings: %v", err)
+	}
+}
+
+// Types a setting can have.
+type SettingValue interface {
+	string | bool | int
+}
+
+type SettingOptions[T SettingValue] struct {
+	Label       string // Shown on the settings page. Default: the key
+	Description string // Shown under the field. Default: none
+	Group       string // Settings are grouped by it on the settings page. Default: "General"
+	Default     T      // Value until an admin changes it.
+	// Bounds of int settings, or of the length of string settings. A bound of 0 isn't checked.
+	Min, Max int
+	Validate func(value T) error // Checks values on top of Min and Max. Default: none
+}
+
+// A runtime setting, see NewSetting.
+type Setting[T SettingValue] struct {
+	Key     string
+	options SettingOptions[T]
+
+	mu          sync.RWMutex
+	value       T
+	subscribers []func(value T)
+}
+
+// Registers a setting and loads its value from the database (once it's open, for the settings of
+// this package). Keys are unique, i.e. "auth.signup_open".
+// Call it when the package is initialized (in a package variable), so the setting is on the settings page.
+func NewSetting[T SettingValue](key string, options SettingOptions[T]) *Setting[T] {
+	if options.Label == "" {
+		options.Label = key
+	}
+	if options.Group == "" {
+		options.Group = "General"
+	}
+	s := &Setting[T]{Key: key, options: options, value: options.Default}
+	if err := s.validate(options.Default); err != nil {
+		log.Fatalf("Error creating setting %s: invalid default: %v", key, err)
+	}
+
+	settingsRegistry.mu.Lock()
+	defer settingsRegistry.mu.Unlock()
+	if _, ok := settingsRegistry.byKey[key]; ok {
+		log.Fatalf("Error creating setting %s: already registered", key)
+	}
+	settingsRegistry.byKey[key] = s
+	settingsRegistry.keys = append(settingsRegistry.keys, key)
+	if SettingsDb == nil {
+		return s
+	}
+
+	var stored string
+	err := SettingsDb.Get(&stored, "SELECT value FROM settings WHERE key = ?", key)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Fatalf("Error loading setting %s: %v", key, err)
+	}
+	if err == nil {
+		s.load(stored)
+	}
+	return s
+}
+
+// Returns the current value.
+func (s *Setting[T]) Get() T {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// Validates and stores the value, then calls the subscribers if it changed.
+func (s *Setting[T]) Set(value T) error {
+	if err := s.validate(value); err != nil {
+		return fmt.Errorf("%s: %v", s.options.Label, err)
+	}
+	_, err := SettingsDb.Exec(`
+	INSERT INTO settings (key, type, value) VALUES (?, ?, ?)
+	ON CONFLICT(key) DO UPDATE SET type = excluded.type, value = excluded.value, updated_at = CURRENT_TIMESTAMP`,
+		s.Key, s.kind(), formatSetting(value))
+	if err != nil {
+		return fmt.Errorf("failed to save setting %s: %v", s.Key, err)
+	}
+	s.update(value)
+	return nil
+}
+
+// Goes back to the default value, removing the stored one.
+func (s *Setting[T]) Reset() error {
+	_, err := SettingsDb.Exec("DELETE FROM settings WHERE key = ?", s.Key)
+	if err != nil {
+		return fmt.Errorf("failed to reset setting %s: %v", s.Key, err)
+	}
+	s.reset()
+	return nil
+}
+
+// Calls fn with the new value whenever the setting changes, from this process or
+// (on the next reload) from another one. fn runs in the goroutine making the change, keep it short.
+func (s *Setting[T]) Subscribe(fn func(value T)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+func (s *Setting[T]) update(value T) {
+	s.mu.Lock()
+	changed := s.value != value
+	s.value = value
+	subscribers := append([]func(T){}, s.subscribers...)
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	for _, fn := range subscribers {
+		fn(value)
+	}
+}
+
+func (s *Setting[T]) validate(value T) error {
+	o := s.options
+	switch v := any(value).(type) {
+	case int:
+		if o.Min != 0 && v < o.Min {
+			return fmt.Errorf("must be at least %d", o.Min)
+		}
+		if o.Max != 0 && v > o.Max {
+			return fmt.Errorf("must be at most %d", o.Max)
+		}
+	case string:
+		if o.Min != 0 && len(v) < o.Min {
+			return fmt.Errorf("must be at least %d characters long", o.Min)
+		}
+		if o.Max != 0 && len(v) > o.Max {
+			return fmt.Errorf("must be at most %d characters long", o.Max)
+		}
+	}
+	if o.Validate != nil {
+		return o.Validate(value)
+	}
+	return nil
+}
+
+func (s *Setting[T]) kind() string {
+	return fmt.Sprintf("%T", s.options.Default)
+}
+
+// Applies a value read from the database. Values that don't parse or validate anymore
+// (i.e. the bounds changed) are ignored, the setting keeps its current value.
+func (s *Setting[T]) load(stored string) {
+	value, err := parseSetting[T](stored)
+	if err == nil {
+		err = s.validate(value)
+	}
+	if err != nil {
+		fmt.Printf("failed to load setting %s: %v\n", s.Key, err)
+		return
+	}
+	s.update(value)
+}
+
+// Goes back to the default value after its stored value was removed.
+func (s *Setting[T]) reset() {
+	s.update(s.options.Default)
+}
+
+func (s *Setting[T]) setString(value string) error {
+	parsed, err := parseSetting[T](value)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.options.Label, err)
+	}
+	if parsed == s.Get() {
+		return nil
+	}
+	return s.Set(parsed)
+}
+
+func (s *Setting[T]) info() SettingInfo {
+	return SettingInfo{
+		Key:         s.Key,
+		Label:       s.options.Label,
+		Description: s.options.Description,
+		Group:       s.options.Group,
+		Type:        s.kind(),
+		Value:       formatSetting(s.Get()),
+		Default:     formatSetting(s.options.Default),
+		Min:         s.options.Min,
+		Max:         s.options.Max,
+	}
+}
+
+func parseSetting[T SettingValue](s string) (T, error) {
+	var value T
+	var err error
+	switch v := any(&value).(type) {
+	case *string:
+		*v = s
+	case *bool:
+		*v, err = strconv.ParseBool(s)
+		if err != nil {
+			err = fmt.Errorf("invalid boolean %q", s)
+		}
+	case *int:
+		*v, err = strconv.Atoi(s)
+		if err != nil {
+			err = fmt.Errorf("invalid integer %q", s)
+		}
+	}
+	return value, err
+}
+
+func formatSetting[T SettingValue](value T) string {
+	return fmt.Sprint(value)
+}
+
+// The type-erased side of Setting, for the registry.
+type registeredSetting interface {
+	info() SettingInfo
+	load(stored string)
+	reset()
+	setString(value string) error
+}
+
+var settingsRegistry = struct {
+	mu    sync.RWMutex
+	byKey map[string]registeredSetting
+	keys  []string // In the order the settings were registered.
+}{byKey: map[string]registeredSetting{}}
+
+// A setting as shown on the settings page, with its values formatted as strings.
+type SettingInfo struct {
+	Key         string
+	Label       string
+	Description string
+	Group       string
+	Type        string // "string", "bool" or "int".
+	Value       string
+	Default     string
+	Min, Max    int
+}
+
+// Returns the registered settings, sorted by group, then in the order they were registered.
+func ListSettings() []SettingInfo {
+	settingsRegistry.mu.RLock()
+	list := make([]SettingInfo, 0, len(settingsRegistry.keys))
+	for _, key := range settingsRegistry.keys {
+		list = append(list, settingsRegistry.byKey[key].info())
+	}
+	settingsRegistry.mu.RUnlock()
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Group < list[j].Group
+	})
+	return list
+}
+
+// Parses and sets the value of a setting, i.e. from a form. Unchanged values aren't stored again.
+func SetSetting(key, value string) error {
+	settingsRegistry.mu.RLock()
+	s, ok := settingsRegistry.byKey[key]
+	settingsRegistry.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	return s.setString(value)
+}
+
+// Reloads the stored values of the settings from the database and notifies the subscribers
+// of the ones that changed. Settings without a stored value (i.e. Reset by another instance)
+// go back to their default.
+func ReloadSettings() error {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	err := SettingsDb.Select(&rows, "SELECT key, value FROM settings")
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]string, len(rows))
+	for _, row := range rows {
+		stored[row.Key] = row.Value
+	}
+
+	settingsRegistry.mu.RLock()
+	keys := append([]string{}, settingsRegistry.keys...)
+	settingsRegistry.mu.RUnlock()
+
+	for _, key := range keys {
+		settingsRegistry.mu.RLock()
+		s := settingsRegistry.byKey[key]
+		settingsRegistry.mu.RUnlock()
+		if value, ok := stored[key]; ok {
+			s.load(value)
+		} else {
+			s.reset()
+		}
+	}
+	return nil
+}
+
+var settingsReload struct {
+	mu   sync.Mutex
+	stop chan struct{} // Closed to stop the reload loop. (nil when it's not running)
+	done chan struct{} // Closed when the reload loop exited.
+}
+
+// Starts reloading the settings from the database every interval, until StopSettingsReload.
+// Does nothing if the reload loop is already running.
+func StartSettingsReload(interval time.Duration) {
+	settingsReload.mu.Lock()
+	defer settingsReload.mu.Unlock()
+	if settingsReload.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	settingsReload.stop, settingsReload.done = stop, done
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := ReloadSettings(); err != nil {
+					fmt.Printf("failed to reload settings: %v\n", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stops the reload loop and waits for a reload in progress, call it before closing SettingsDb.
+func StopSettingsReload() {
+	settingsReload.mu.Lock()
+	defer settingsReload.mu.Unlock()
+	if settingsReload.stop == nil {
+		return
+	}
+	close(settingsReload.stop)
+	<-settingsReload.done
+	settingsReload.stop, settingsReload.done = nil, nil
+}
+
+// The name of the site, shown in the titles of the pages.
+var SiteName = NewSetting("site.name", SettingOptions[string]{
+	Label:       "Site name",
+	Description: "Shown in the titles of the pages.",
+	Default:     "Go on Rails",
+	Min:         1,
+	Max:         100,
+})
@@ -0,0 +1,27 @@
+package common
+
+import "testing"
+
+// Registered once like the settings of the app, so the tests can run several times (-count).
+var (
+	minOnly = NewSetting("test.min_only", SettingOptions[int]{Default: 8, Min: 8})
+	maxOnly = NewSetting("test.max_only", SettingOptions[string]{Default: "ok", Max: 5})
+)
+
+func TestSettingBounds(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func() error
+		ok   bool
+	}{
+		{"above min", func() error { return minOnly.Set(1000) }, true},
+		{"below min", func() error { return minOnly.Set(7) }, false},
+		{"within max", func() error { return maxOnly.Set("") }, true},
+		{"above max", func() error { return maxOnly.Set("too long") }, false},
+	}
+	for _, test := range tests {
+		if err := test.set(); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+}
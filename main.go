@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"go-on-rails/auth"
+	"go-on-rails/common"
 	"go-on-rails/marketing"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/logger"
@@ -14,19 +20,77 @@ import (
 // from other modules here.
 // Don't put too much logic here, just enough to get the app running.
 
+// How long in-flight requests and jobs get to finish when shutting down.
+// Keep it (plus common.QueueShutdownGracePeriod) below the time docker gives the container
+// to stop (see docker-compose.yml).
+const shutdownTimeout = 20 * time.Second
+
 func main() {
 	log.Println("Starting server on port 3000")
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		// Idle keep-alive connections would otherwise hold the shutdown until it times out.
+		IdleTimeout: 5 * time.Second,
+	})
 	app.Use(logger.New())
+	app.Use(common.ConditionalResponses(common.ConditionalOptions{}))
 
 	// routes
+	app.Use(common.StaticValidators("./public"))
 	app.Static("/", "./public")
 	marketing.AddRoutes(app)
 	auth.AddRoutes(app)
 
-	err := app.Listen(":3000")
-	if err != nil {
+	// Pick up the settings changed by the other instances of the app.
+	common.StartSettingsReload(30 * time.Second)
+
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(":3000")
+	}()
+
+	// Wait for Ctrl+C (SIGINT) or docker stop (SIGTERM), or for the server to fail.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	case err := <-listenErr:
 		log.Println("Error starting server")
 		log.Println(err)
 	}
+
+	shutdown(app)
+}
+
+// Stops accepting requests, lets in-flight requests and queued jobs finish
+// and closes the databases.
+func shutdown(app *fiber.App) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err := app.ShutdownWithContext(ctx)
+	if err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+
+	err = common.ShutdownQueues(ctx)
+	if err != nil {
+		log.Printf("Error shutting down job queues: %v", err)
+	}
+
+	err = auth.AuthDb.Close()
+	if err != nil {
+		log.Printf("Error closing auth database: %v", err)
+	}
+	err = common.MailDb.Close()
+	if err != nil {
+		log.Printf("Error closing mail database: %v", err)
+	}
+	common.StopSettingsReload()
+	err = common.SettingsDb.Close()
+	if err != nil {
+		log.Printf("Error closing settings database: %v", err)
+	}
+
+	log.Println("Server stopped")
 }
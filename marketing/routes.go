@@ -1,6 +1,7 @@
 package marketing
 
 import (
+	"fmt"
 	"go-on-rails/auth"
 	"go-on-rails/common"
 	"time"
@@ -8,13 +9,29 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
+// Rendered marketing pages, they're the same for every visitor that isn't logged in.
+var pageCache = common.NewCacheStore(common.CacheStoreOptions{MaxBytes: 16 << 20})
+
+func init() {
+	// the site name is in the cached pages
+	common.SiteName.Subscribe(func(string) {
+		if err := pageCache.Clear(); err != nil {
+			fmt.Printf("failed to clear the page cache: %v\n", err)
+		}
+	})
+}
+
 func AddRoutes(app *fiber.App) {
-	app.Get("/", func(c *fiber.Ctx) error {
-		common.SetCacheHeader(c, common.CacheOptions{
-			MaxAge:               24 * time.Hour,
-			StaleWhileRevalidate: 1 * time.Hour,
-			StaleIfError:         1 * time.Hour,
-		})
+	homeCacheOptions := common.CacheOptions{
+		MaxAge:               24 * time.Hour,
+		StaleWhileRevalidate: 1 * time.Hour,
+		StaleIfError:         1 * time.Hour,
+	}
+	app.Get("/", common.CacheResponses(common.ResponseCacheOptions{
+		Store:        pageCache,
+		CacheOptions: homeCacheOptions,
+	}), func(c *fiber.Ctx) error {
+		common.SetCacheHeader(c, homeCacheOptions)
 		return common.RenderTempl(c, home_page())
 	})
 